@@ -1,20 +1,22 @@
 package media_processing_workflow
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/xfrr/goffmpeg/transcoder"
 	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
 )
 
 type Activities struct {
@@ -23,6 +25,20 @@ type Activities struct {
 	Transcoder                   *transcoder.Transcoder
 	OutputFileType               string
 	FileUploadEndpoint           string
+	// WorkspaceRoot is where per-run workspaces are created; defaults to a directory in the OS temp dir
+	WorkspaceRoot string
+	// MinFreeDiskBytes is the free space required to create a workspace; defaults to DefaultMinFreeDiskBytes
+	MinFreeDiskBytes uint64
+	// HTTPClient is used for uploads; defaults to a client with connection and response header timeouts
+	HTTPClient *http.Client
+	// ResumableUploadEndpoint enables the resumable upload protocol for files larger than one chunk
+	ResumableUploadEndpoint string
+	// UploadChunkSize is the size of resumable upload chunks; defaults to DefaultUploadChunkSize
+	UploadChunkSize int64
+	// S3 configures the object store of s3:// destinations
+	S3 S3Config
+	// UploadCredentials authenticate the uploads to the internal API
+	UploadCredentials UploadCredentials
 }
 
 /**
@@ -89,64 +105,75 @@ func (a *Activities) GetMediaURLsActivity(ctx context.Context, deviceID string)
 	return urls.Links, nil
 }
 
-// DownloadFilesActivity creates temporary files and download the media files at the provided fileURLs into the temp files
-// and return an array containing paths to the temp files.
+// DownloadFilesActivity creates files in the workspace and downloads the media files at the provided fileURLs into them
+// and return an array containing paths to the downloaded files.
 // As a side effect, the activity records heartbeats of the activity execution to the Temporal service
-func (a *Activities) DownloadFilesActivity(ctx context.Context, fileURLs []string) ([]string, error) {
+func (a *Activities) DownloadFilesActivity(ctx context.Context, ws Workspace, fileURLs []string) ([]string, error) {
 	logger := activity.GetLogger(ctx)
 	downloadedFiles := []string{}
 	for _, fileURL := range fileURLs {
 
 		logger.Info("Downloading file...", "fileURL", fileURL)
 
-		tmpFile, err := ioutil.TempFile("", "videoFile")
+		fileName, err := downloadFile(ws, fileURL)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Err creating temp file %s", err.Error()))
+			logger.Error("Error downloading file", "fileURL", fileURL, "Error", err)
 			return downloadedFiles, err
 		}
 
-		filePath := tmpFile.Name()
-
-		file, err := os.Create(filePath)
-		if err != nil {
-			logger.Error("Err creating file to save to", "filePath", filePath)
-			return downloadedFiles, err
-		}
-		defer file.Close()
-
-		logger.Info(fmt.Sprintf("created file with name %s", file.Name()))
+		logger.Info(fmt.Sprintf("saved file with name %s", fileName))
+		downloadedFiles = append(downloadedFiles, fileName)
+		activity.RecordHeartbeat(ctx, len(downloadedFiles))
+	}
+	return downloadedFiles, nil
+}
 
-		resp, err := http.Get(fileURL)
-		if err != nil {
-			logger.Error("http error downloading file", "fileURL", fileURL)
-			return downloadedFiles, err
-		}
-		defer resp.Body.Close()
+func downloadFile(ws Workspace, fileURL string) (string, error) {
+	file, err := ws.TempFile("videoFile-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
 
-		_, err = io.Copy(file, resp.Body)
-		if err != nil {
-			logger.Error("Error copying downloaded file to filepath")
-			return downloadedFiles, err
-		}
+	resp, err := http.Get(fileURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-		logger.Info(fmt.Sprintf("saved file with name %s", file.Name()))
-		downloadedFiles = append(downloadedFiles, file.Name())
+	_, err = io.Copy(file, resp.Body)
+	if err != nil {
+		return "", err
 	}
-	return downloadedFiles, nil
+	return file.Name(), nil
 }
 
-// EncodeFileActivity encodes the downloaded file into the expected output
+// EncodeFileActivity encodes the downloaded file into the expected output within the workspace, trimming it to
+// params.Range and burning in the overlay of the encoding profile.
 // **NOTE:** In production settings, we'd want to update up this function to better
 // handle specifics of the media encoding. This is a simple activity to illustrate
 // an end-to-end example using Temporal.
-func (a *Activities) EncodeFileActivity(ctx context.Context, fileName string) (string, error) {
+func (a *Activities) EncodeFileActivity(ctx context.Context, ws Workspace, fileName string, params EncodeParams) (string, error) {
 	logger := activity.GetLogger(ctx)
-	tmpFile, err := ioutil.TempFile("", "encodedFile")
+	baseName := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	outputFilePath, err := ws.Path(fmt.Sprintf("%s-encoded.%s", baseName, a.OutputFileType))
 	if err != nil {
-		logger.Error(fmt.Sprintf("Err creating temp file %s", err.Error()))
-		return "", err
+		return "", temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidWorkspace, nil)
+	}
+
+	if err := params.Range.Validate(); err != nil {
+		return "", temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidClipRange, nil)
+	}
+
+	var videoFilter string
+	if overlay := params.Profile.Overlay; overlay != nil {
+		var err error
+		videoFilter, err = overlayVideoFilter(ctx, ws, fileName, params, *overlay)
+		if err != nil {
+			logger.Error("Err preparing overlay", "Error", err)
+			return "", err
+		}
 	}
-	outputFilePath := fmt.Sprintf("%s.%s", tmpFile.Name(), a.OutputFileType)
 
 	err = a.Transcoder.Initialize(fileName, outputFilePath)
 
@@ -154,6 +181,16 @@ func (a *Activities) EncodeFileActivity(ctx context.Context, fileName string) (s
 		logger.Error(fmt.Sprintf("Err initializing ffmpeg transcoder %s", err.Error()))
 		return "", err
 	}
+	if videoFilter != "" {
+		a.Transcoder.MediaFile().SetVideoFilter(videoFilter)
+	}
+	// seeking on the input while re-encoding decodes up to the in point, so the cut is frame-accurate
+	if params.Range.Start > 0 {
+		a.Transcoder.MediaFile().SetSeekTimeInput(ffmpegSeconds(params.Range.Start))
+	}
+	if params.Range.End > 0 {
+		a.Transcoder.MediaFile().SetDuration(ffmpegSeconds(params.Range.Duration()))
+	}
 	// Start transcoder with the `true` flag to show the progress
 	done := a.Transcoder.Run(true)
 
@@ -173,36 +210,60 @@ func (a *Activities) EncodeFileActivity(ctx context.Context, fileName string) (s
 	return outputFilePath, nil
 }
 
+// overlayVideoFilter renders the overlay for one clip and returns the filtergraph that burns it into the video
+func overlayVideoFilter(ctx context.Context, ws Workspace, fileName string, params EncodeParams, overlay Overlay) (string, error) {
+	if err := overlay.Validate(); err != nil {
+		return "", temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidOverlay, nil)
+	}
+	if overlay.Text == "" {
+		return overlay.videoFilter(""), nil
+	}
+
+	probe, err := ProbeMedia(ctx, fileName)
+	if err != nil {
+		return "", err
+	}
+	text, err := overlay.overlayText(params.DeviceID, params.ClipIndex, captureTime(probe), params.Range.Start)
+	if err != nil {
+		return "", temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidOverlay, nil)
+	}
+
+	// drawtext reads the text from a file so that it does not need filtergraph escaping
+	textFile, err := ws.Path(fmt.Sprintf("overlay-%d.txt", params.ClipIndex))
+	if err != nil {
+		return "", temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidWorkspace, nil)
+	}
+	if err := ioutil.WriteFile(textFile, []byte(text), 0644); err != nil {
+		return "", err
+	}
+	return overlay.videoFilter(textFile), nil
+}
+
+// writefileNamesToFile writes the concat demuxer list for fileNames to path, replacing any previous contents.
+// Entries are written as absolute paths since the demuxer resolves relative entries against the list file.
 func writefileNamesToFile(path string, fileNames []string) error {
-	var file, err = os.OpenFile(path, os.O_RDWR, 0644)
+	var file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		fmt.Println(err.Error())
 		return err
 	}
 	defer file.Close()
 
 	for _, f := range fileNames {
-		_, err = file.WriteString(fmt.Sprintf("file '%s'\n", f))
+		absPath, err := filepath.Abs(f)
+		if err != nil {
+			return err
+		}
+		entry, err := concatListEntry(absPath)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString(entry)
 		if err != nil {
-			fmt.Println(err.Error())
 			return err
 		}
 	}
 
-	err = file.Sync()
-	if err != nil {
-		fmt.Println(err.Error())
-		return err
-	}
-	return nil
-}
-
-func createTempFile(prefix string) (string, error) {
-	tmpFile, err := ioutil.TempFile("", prefix)
-	if err != nil {
-		return "", err
-	}
-	return tmpFile.Name(), nil
+	return file.Sync()
 }
 
 func deleteTempFile(fileName string) error {
@@ -213,92 +274,134 @@ func deleteTempFile(fileName string) error {
 	return nil
 }
 
-// MergeFilesActivity combines the media files into one file based on the ordering in the input array
-func (a *Activities) MergeFilesActivity(ctx context.Context, fileNames []string, outputFileName string) (string, error) {
-	logger := activity.GetLogger(ctx)
+// pathSafeName replaces characters that are not safe within a single path element
+func pathSafeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
 
-	// Use ffmpeg to concatenate instructions from here: https://trac.ffmpeg.org/wiki/Concatenate
-	// The recommended approach utilizes a file that includes a list of files to merge.
-	fileContaingFilesToMerge, err := createTempFile("filesToMerge")
-	err = writefileNamesToFile(fileContaingFilesToMerge, fileNames)
+// MergeFilesActivity combines the media files into one file based on the ordering in the input array.
+// Clips that share codecs, resolution, timebase and audio layout are joined with a stream copy through the
+// concat demuxer; otherwise, or when audio processing is requested, the clips are normalized and re-encoded
+// through the concat filter.
+// The output is written to outputFileName inside the workspace once ffmpeg succeeds; outputFileName must be a plain
+// file name. The workspace belongs to the run, so a retried merge replaces its own output; collisions with earlier
+// outputs are checked by the destination when the output is stored.
+func (a *Activities) MergeFilesActivity(ctx context.Context, ws Workspace, fileNames []string, outputFileName string, options MergeOptions) (MergeResult, error) {
+	logger := activity.GetLogger(ctx)
+	outputFileName, err := ws.Path(outputFileName)
 	if err != nil {
-		return "", err
+		return MergeResult{}, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidOutputName, nil)
 	}
+	result := MergeResult{FileName: outputFileName, Strategy: MergeStrategyConcatDemuxer}
 
-	ffMpegCommand := "ffmpeg"
-	arg0 := "-f"
-	arg1 := "concat"
-	arg2 := "-safe"
-	arg3 := "0"
-	arg4 := "-i"
-	arg5 := fileContaingFilesToMerge
-	arg6 := "-c"
-	arg7 := "copy"
-	arg8 := outputFileName
-
-	cmd := exec.Command(ffMpegCommand, arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8)
-	stdout, err := cmd.Output()
+	renderedFileName, err := ws.Path("merge-in-progress" + filepath.Ext(outputFileName))
 	if err != nil {
-		logger.Error("error executing command")
-		logger.Error(err.Error())
-		return "", err
+		return result, err
 	}
-	logger.Info(string(stdout))
 
-	err = deleteTempFile(fileContaingFilesToMerge)
-	if err != nil {
-		logger.Error(fmt.Sprintf("unable to delete file %s", fileContaingFilesToMerge))
+	probes := []MediaProbe{}
+	for _, f := range fileNames {
+		probe, err := ProbeMedia(ctx, f)
+		if err != nil {
+			logger.Error("unable to probe file to merge", "file", f, "Error", err)
+			return result, err
+		}
+		probes = append(probes, probe)
 	}
 
-	return outputFileName, nil
-}
-
-// UploadFileActivity uploads the provided file to the internal API
-func (a *Activities) UploadFileActivity(ctx context.Context, fileName string) (bool, error) {
-	targetUrl := a.FileUploadEndpoint
+	if err := options.Range.Validate(); err != nil {
+		return result, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidClipRange, nil)
+	}
 
-	buffer := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(buffer)
+	if reason := options.filterReason(); reason != "" {
+		result.Strategy = MergeStrategyConcatFilter
+		result.Reason = reason
+	} else if mismatch := concatMismatch(probes); mismatch != "" {
+		result.Strategy = MergeStrategyConcatFilter
+		result.Reason = mismatch
+	}
+	logger.Info("merging files", "strategy", result.Strategy, "reason", result.Reason)
+
+	var args []string
+	switch result.Strategy {
+	case MergeStrategyConcatDemuxer:
+		// Use ffmpeg to concatenate instructions from here: https://trac.ffmpeg.org/wiki/Concatenate
+		// The recommended approach utilizes a file that includes a list of files to merge.
+		fileContaingFilesToMerge, err := ws.Path("filesToMerge.txt")
+		if err != nil {
+			return result, err
+		}
+		err = writefileNamesToFile(fileContaingFilesToMerge, fileNames)
+		if err != nil {
+			logger.Error("unable to write concat list file", "Error", err)
+			return result, err
+		}
+		defer func() {
+			if err := deleteTempFile(fileContaingFilesToMerge); err != nil {
+				logger.Error(fmt.Sprintf("unable to delete file %s", fileContaingFilesToMerge))
+			}
+		}()
+		args = []string{"-f", "concat", "-safe", "0", "-i", fileContaingFilesToMerge, "-c", "copy", renderedFileName}
+	case MergeStrategyConcatFilter:
+		target, err := newMergeTarget(probes, options)
+		if err != nil {
+			return result, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeUnmergeableMedia, nil)
+		}
+		args = concatFilterArgs(fileNames, probes, target, renderedFileName)
+	}
+	// the range applies to the merged timeline, so it is passed as output options right before the output file
+	args = append(args[:len(args)-1], append(options.Range.outputArgs(), renderedFileName)...)
 
-	fileWriter, err := bodyWriter.CreateFormFile(FileNameAttribute, fileName)
+	// a rendered file left behind by a failed attempt is always replaced
+	cmd := exec.CommandContext(ctx, FFmpegCommand, append([]string{"-y"}, args...)...)
+	output, err := cmd.CombinedOutput()
 	if err != nil {
-		fmt.Println("error creating form file")
-		return false, err
+		logger.Error("error executing command", "Error", err, "output", string(output))
+		return result, err
 	}
+	logger.Info(string(output))
 
-	fh, err := os.Open(fileName)
+	err = os.Rename(renderedFileName, outputFileName)
 	if err != nil {
-		fmt.Println("error while opening file")
-		return false, err
+		logger.Error("unable to move merged file to output", "output", outputFileName, "Error", err)
+		return result, err
 	}
-	defer fh.Close()
 
-	_, err = io.Copy(fileWriter, fh)
+	merged, err := ProbeMedia(ctx, outputFileName)
 	if err != nil {
-		return false, err
+		logger.Error("unable to probe merged file", "output", outputFileName, "Error", err)
+		return result, err
 	}
+	result.Duration = time.Duration(merged.Duration() * float64(time.Second))
 
-	formDataContentType := bodyWriter.FormDataContentType()
-	bodyWriter.Close()
+	return result, nil
+}
 
-	resp, err := http.Post(targetUrl, formDataContentType, buffer)
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
+// UploadFileActivity stores the provided file at the destination selected by params.Destination and returns where it
+// was stored; an empty destination selects the internal API. The file is never buffered in memory and the progress
+// is recorded as heartbeat details. Uploads the destination rejects as invalid or too large fail with a
+// non-retryable error.
+func (a *Activities) UploadFileActivity(ctx context.Context, fileName string, params UploadParams) (UploadResult, error) {
+	logger := activity.GetLogger(ctx)
 
-	respBody, err := ioutil.ReadAll(resp.Body)
+	destination, err := a.destination(params.Destination)
 	if err != nil {
-		return false, err
+		logger.Error("invalid destination", "destination", params.Destination, "Error", err)
+		return UploadResult{}, err
 	}
-
-	fmt.Println(resp.Status)
-	fmt.Println(fmt.Sprintf("Response body: %s", string(respBody)))
-
-	// Delete File as a side effect; Ideally, move this into its own Activity.
-	if resp.StatusCode == int(http.StatusOK) {
-		deleteTempFile(fileName)
+	metadata := UploadMetadata{DeviceID: params.DeviceID, WorkflowID: activity.GetInfo(ctx).WorkflowExecution.ID}
+	result, err := destination.Store(ctx, fileName, metadata, params.Overwrite)
+	if err != nil {
+		logger.Error("error uploading file", "file", fileName, "destination", params.Destination, "Error", err)
+		return UploadResult{}, err
 	}
-
-	return true, nil
+	logger.Info("uploaded file", "id", result.ID, "location", result.Location)
+	return result, nil
 }
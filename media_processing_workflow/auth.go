@@ -0,0 +1,136 @@
+package media_processing_workflow
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyHeader carries a static API key of the internal API
+	APIKeyHeader = "X-Api-Key"
+
+	// DefaultUploadTokenTTL is how long the upload tokens minted by the worker are valid
+	DefaultUploadTokenTTL = 5 * time.Minute
+	// DefaultWebhookTolerance is how far the timestamp of a signed webhook delivery may be from the clock of the
+	// receiver; older deliveries are rejected as replays
+	DefaultWebhookTolerance = 5 * time.Minute
+)
+
+// errors reported by VerifyUploadToken
+var (
+	ErrMalformedUploadToken = errors.New("malformed upload token")
+	ErrInvalidUploadToken   = errors.New("invalid upload token signature")
+	ErrExpiredUploadToken   = errors.New("expired upload token")
+)
+
+// errors reported by VerifyPayloadSignature
+var (
+	ErrMalformedWebhookTimestamp = errors.New("malformed webhook timestamp")
+	ErrInvalidWebhookSignature   = errors.New("invalid webhook signature")
+	ErrStaleWebhookTimestamp     = errors.New("webhook timestamp outside the tolerance")
+)
+
+// UploadCredentials authenticate the worker to the internal API. When a token secret is configured, every request
+// carries a freshly signed upload token; otherwise the static API key is sent, if any.
+type UploadCredentials struct {
+	APIKey string
+	// TokenSecret is the HMAC key shared with the internal API
+	TokenSecret string
+	// TokenTTL is the validity of the minted tokens; defaults to DefaultUploadTokenTTL
+	TokenTTL time.Duration
+}
+
+// authorize adds the credentials to a request of the internal API; subject identifies the client in the token
+func (c UploadCredentials) authorize(req *http.Request, subject string, now time.Time) {
+	switch {
+	case c.TokenSecret != "":
+		ttl := c.TokenTTL
+		if ttl <= 0 {
+			ttl = DefaultUploadTokenTTL
+		}
+		req.Header.Set("Authorization", "Bearer "+NewUploadToken([]byte(c.TokenSecret), subject, now.Add(ttl)))
+	case c.APIKey != "":
+		req.Header.Set(APIKeyHeader, c.APIKey)
+	}
+}
+
+// UploadTokenClaims is the signed payload of an upload token
+type UploadTokenClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// NewUploadToken signs an upload token for the subject that expires at the given time. The token is the base64url
+// encoded json claims and their HMAC-SHA256 signature, separated by a dot.
+func NewUploadToken(secret []byte, subject string, expiresAt time.Time) string {
+	payload, _ := json.Marshal(UploadTokenClaims{Subject: subject, ExpiresAt: expiresAt.Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(secret, encoded))
+}
+
+// VerifyUploadToken checks the signature and expiry of an upload token and returns its claims
+func VerifyUploadToken(secret []byte, token string, now time.Time) (UploadTokenClaims, error) {
+	var claims UploadTokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, ErrMalformedUploadToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrMalformedUploadToken
+	}
+	if !hmac.Equal(signature, hmacSHA256(secret, parts[0])) {
+		return claims, ErrInvalidUploadToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrMalformedUploadToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrMalformedUploadToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrExpiredUploadToken
+	}
+	return claims, nil
+}
+
+// SignPayload returns the signature of a webhook body sent at the given time, "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the unix timestamp, a dot and the body with the secret of the webhook. The timestamp is sent in the
+// X-Webhook-Timestamp header, so that receivers can reject replayed deliveries.
+func SignPayload(secret []byte, timestamp time.Time, body []byte) string {
+	return signTimestampedPayload(secret, strconv.FormatInt(timestamp.Unix(), 10), body)
+}
+
+func signTimestampedPayload(secret []byte, timestamp string, body []byte) string {
+	return "sha256=" + hex.EncodeToString(hmacSHA256(secret, timestamp+"."+string(body)))
+}
+
+// VerifyPayloadSignature checks that the signature was made by SignPayload with the secret for the body and the
+// timestamp header, and that the timestamp is within the tolerance of now
+func VerifyPayloadSignature(secret []byte, body []byte, timestamp string, signature string, now time.Time, tolerance time.Duration) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMalformedWebhookTimestamp
+	}
+	if !hmac.Equal([]byte(signature), []byte(signTimestampedPayload(secret, timestamp, body))) {
+		return ErrInvalidWebhookSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrStaleWebhookTimestamp
+	}
+	return nil
+}
+
+// SignWebhookRequest sets the timestamp and signature headers of a webhook delivery with the secret
+func SignWebhookRequest(req *http.Request, secret []byte, body []byte, now time.Time) {
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(WebhookSignatureHeader, SignPayload(secret, now, body))
+}
@@ -0,0 +1,60 @@
+package media_processing_workflow
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UploadToken(t *testing.T) {
+	now := time.Now()
+	secret := []byte("secret")
+	token := NewUploadToken(secret, "workflowId", now.Add(time.Minute))
+
+	claims, err := VerifyUploadToken(secret, token, now)
+	assert.NoError(t, err)
+	assert.Equal(t, UploadTokenClaims{Subject: "workflowId", ExpiresAt: now.Add(time.Minute).Unix()}, claims)
+
+	_, err = VerifyUploadToken(secret, token, now.Add(time.Minute))
+	assert.Equal(t, ErrExpiredUploadToken, err)
+
+	_, err = VerifyUploadToken([]byte("other secret"), token, now)
+	assert.Equal(t, ErrInvalidUploadToken, err)
+
+	// the claims cannot be changed without invalidating the signature
+	parts := strings.Split(token, ".")
+	forged := NewUploadToken(secret, "workflowId", now.Add(time.Hour))
+	_, err = VerifyUploadToken(secret, strings.Split(forged, ".")[0]+"."+parts[1], now)
+	assert.Equal(t, ErrInvalidUploadToken, err)
+
+	_, err = VerifyUploadToken(secret, "not a token", now)
+	assert.Equal(t, ErrMalformedUploadToken, err)
+}
+
+func Test_PayloadSignature(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	secret := []byte("secret")
+	sentAt := time.Unix(1622548800, 0)
+	timestamp := "1622548800"
+	signature := SignPayload(secret, sentAt, body)
+	assert.True(t, strings.HasPrefix(signature, "sha256="))
+
+	assert.NoError(t, VerifyPayloadSignature(secret, body, timestamp, signature, sentAt.Add(time.Minute), DefaultWebhookTolerance))
+	assert.NoError(t, VerifyPayloadSignature(secret, body, timestamp, signature, sentAt.Add(-time.Minute), DefaultWebhookTolerance))
+	assert.Equal(t, ErrInvalidWebhookSignature, VerifyPayloadSignature([]byte("other secret"), body, timestamp, signature, sentAt, DefaultWebhookTolerance))
+	assert.Equal(t, ErrInvalidWebhookSignature, VerifyPayloadSignature(secret, []byte(`{"id":"2"}`), timestamp, signature, sentAt, DefaultWebhookTolerance))
+	// the timestamp is signed, so a replay cannot be made to look recent
+	assert.Equal(t, ErrInvalidWebhookSignature, VerifyPayloadSignature(secret, body, "1622549400", signature, sentAt.Add(10*time.Minute), DefaultWebhookTolerance))
+	assert.Equal(t, ErrStaleWebhookTimestamp, VerifyPayloadSignature(secret, body, timestamp, signature, sentAt.Add(10*time.Minute), DefaultWebhookTolerance))
+	assert.Equal(t, ErrStaleWebhookTimestamp, VerifyPayloadSignature(secret, body, timestamp, signature, sentAt.Add(-10*time.Minute), DefaultWebhookTolerance))
+	assert.Equal(t, ErrMalformedWebhookTimestamp, VerifyPayloadSignature(secret, body, "", signature, sentAt, DefaultWebhookTolerance))
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/hook", nil)
+	assert.NoError(t, err)
+	SignWebhookRequest(req, secret, body, sentAt)
+	assert.Equal(t, timestamp, req.Header.Get(WebhookTimestampHeader))
+	assert.Equal(t, signature, req.Header.Get(WebhookSignatureHeader))
+}
@@ -1,5 +1,7 @@
 package media_processing_workflow
 
+import "time"
+
 const (
 	// media URL statuses
 	Success       = "success"
@@ -13,9 +15,61 @@ const (
 	// encoding output type
 	EncodedOutputFileType = "mp4"
 
+	// media tooling executables
+	FFmpegCommand  = "ffmpeg"
+	FFprobeCommand = "ffprobe"
+
+	// non-retryable application error types
+	ErrTypeOutputExists       = "OutputExists"
+	ErrTypeInvalidWorkspace   = "InvalidWorkspace"
+	ErrTypeUnmergeableMedia   = "UnmergeableMedia"
+	ErrTypeInvalidOverlay     = "InvalidOverlay"
+	ErrTypeInvalidClipRange   = "InvalidClipRange"
+	ErrTypeUploadRejected     = "UploadRejected"
+	ErrTypeInvalidDestination = "InvalidDestination"
+	ErrTypeInvalidMedia       = "InvalidMedia"
+	ErrTypeQuotaExceeded      = "QuotaExceeded"
+	ErrTypeInvalidOutputName  = "InvalidOutputName"
+
+	// retryable application error types
+	ErrTypeInsufficientDiskSpace = "InsufficientDiskSpace"
+	ErrTypeUploadFailed          = "UploadFailed"
+
 	// upload file name attribute
 	FileNameAttribute = "uploadfile"
 	FileUploadEndpoint = "http://localhost:9220/uploadmedia"
+
+	// resumable upload protocol, modeled after tus (https://tus.io/protocols/resumable-upload.html):
+	// POST creates an upload of Upload-Length bytes, PATCH appends a chunk at Upload-Offset and
+	// HEAD reports the Upload-Offset the server has stored so far.
+	ResumableUploadEndpoint      = "http://localhost:9220/uploads"
+	UploadLengthHeader           = "Upload-Length"
+	UploadOffsetHeader           = "Upload-Offset"
+	OffsetOctetStreamContentType = "application/offset+octet-stream"
+
+	// IdempotencyKeyHeader identifies an upload across retries; the internal API stores each key only once
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// upload metadata recorded in the catalog of the internal API
+	DeviceIDHeader   = "X-Device-Id"
+	WorkflowIDHeader = "X-Workflow-Id"
+
+	// APIErrorCodeInvalidMedia is the code of the error the internal API answers with when an upload is not
+	// a decodable media file or breaks the validation rules of the server
+	APIErrorCodeInvalidMedia = "invalid_media"
+	// APIErrorCodeQuotaExceeded is the code of the error the internal API answers with when an upload would exceed
+	// the storage quota of its device
+	APIErrorCodeQuotaExceeded = "quota_exceeded"
+
+	// UploadCompletedEvent is the type of the event emitted for every stored upload
+	UploadCompletedEvent = "upload.completed"
+	// MediaStatusChangedEvent is the type of the notification the vendor API sends when the media of a device
+	// stops being pending
+	MediaStatusChangedEvent = "media.status_changed"
+	// webhook deliveries carry the event ID and, when the webhook has a secret, the time of the delivery and the
+	// signature of both the time and the body
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
 )
 
 // MediaURLs is the struct for the json response of /mediaurls endpoint
@@ -29,3 +83,49 @@ type MediaStatus struct {
 	DeviceId string `json:"deviceId"`
 	Status string `json:"status"`
 }
+
+// UploadRecord is the json response of the internal API describing a stored upload; the internal API keeps
+// a catalog of these records
+type UploadRecord struct {
+	ID       string `json:"id"`
+	FileName string `json:"fileName"`
+	// Location is the path the file can be downloaded from on the internal API
+	Location   string `json:"location"`
+	DeviceID   string `json:"deviceId,omitempty"`
+	WorkflowID string `json:"workflowId,omitempty"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	// Duration of the media in seconds; zero when it could not be probed
+	Duration   float64   `json:"duration"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// UploadEvent is emitted by the internal API to webhooks and the /events stream when an upload is stored
+type UploadEvent struct {
+	// ID is unique per event; webhook receivers use it to ignore redelivered events
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Record    UploadRecord `json:"record"`
+}
+
+// MediaStatusChange is posted by the vendor API to the registered callbacks when the media status of a device
+// changes from pending to success or not_obtainable
+type MediaStatusChange struct {
+	// ID is unique per notification; receivers use it to ignore redelivered notifications
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	CreatedAt      time.Time `json:"createdAt"`
+	DeviceId       string    `json:"deviceId"`
+	PreviousStatus string    `json:"previousStatus"`
+	Status         string    `json:"status"`
+}
+
+// APIError is the json response of the internal API when a request fails
+type APIError struct {
+	Message string `json:"error"`
+	// Code classifies the error for clients; empty for errors without a code
+	Code string `json:"code,omitempty"`
+	// Details lists the individual problems found, e.g. every validation rule an upload breaks
+	Details []string `json:"details,omitempty"`
+}
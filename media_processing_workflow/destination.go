@@ -0,0 +1,287 @@
+package media_processing_workflow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// destination URI schemes; an empty destination URI selects the internal API
+const (
+	DestinationSchemeFile = "file"
+	DestinationSchemeS3   = "s3"
+)
+
+// Destination stores the merged output of a workflow
+type Destination interface {
+	// Store copies the local file to the destination and returns where it was stored. Storing the same file again,
+	// as a retried activity does, must not produce a second copy. Destinations that store files by name refuse to
+	// replace a different file of the same name unless overwrite is set; the others reject overwrite.
+	Store(ctx context.Context, fileName string, metadata UploadMetadata, overwrite bool) (UploadResult, error)
+}
+
+// parseDestinationURI validates a destination URI:
+//   - "" stores the output through the internal API
+//   - file:///mnt/media stores the output in a local or NFS mounted directory of the worker host
+//   - s3://bucket/prefix stores the output in an S3 compatible object store configured on the worker
+func parseDestinationURI(destinationURI string) (*url.URL, error) {
+	if destinationURI == "" {
+		return &url.URL{}, nil
+	}
+	u, err := url.Parse(destinationURI)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidDestination, nil)
+	}
+
+	switch u.Scheme {
+	case DestinationSchemeFile:
+		if (u.Host != "" && u.Host != "localhost") || !filepath.IsAbs(u.Path) {
+			err = fmt.Errorf("destination %q must name an absolute directory on the worker host", destinationURI)
+		}
+	case DestinationSchemeS3:
+		if u.Host == "" {
+			err = fmt.Errorf("destination %q must name a bucket", destinationURI)
+		}
+	default:
+		err = fmt.Errorf("destination %q has an unsupported scheme", destinationURI)
+	}
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidDestination, nil)
+	}
+	return u, nil
+}
+
+// validateDestination checks the destination URI and that the destination can honour overwrite: the internal API
+// stores every upload under a new ID, so an output can neither collide with nor replace a stored file there
+func validateDestination(destinationURI string, overwrite bool) error {
+	u, err := parseDestinationURI(destinationURI)
+	if err != nil {
+		return err
+	}
+	if overwrite && u.Scheme == "" {
+		return errOverwriteUnsupported()
+	}
+	return nil
+}
+
+func errOverwriteUnsupported() error {
+	return temporal.NewNonRetryableApplicationError(
+		"overwrite is only supported by destinations that store files by name; the internal API never replaces a stored file",
+		ErrTypeInvalidDestination, nil)
+}
+
+// destination returns the Destination selected by the URI
+func (a *Activities) destination(destinationURI string) (Destination, error) {
+	u, err := parseDestinationURI(destinationURI)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case DestinationSchemeFile:
+		return &directoryDestination{dir: filepath.Clean(u.Path)}, nil
+	case DestinationSchemeS3:
+		if a.S3.Endpoint == "" {
+			return nil, temporal.NewNonRetryableApplicationError("no S3 endpoint is configured on the worker", ErrTypeInvalidDestination, nil)
+		}
+		return &s3Destination{
+			config: a.S3,
+			client: a.httpClient(),
+			bucket: u.Host,
+			prefix: strings.Trim(u.Path, "/"),
+		}, nil
+	default:
+		chunkSize := a.UploadChunkSize
+		if chunkSize <= 0 {
+			chunkSize = DefaultUploadChunkSize
+		}
+		return &internalAPIDestination{
+			client:            a.httpClient(),
+			endpoint:          a.FileUploadEndpoint,
+			resumableEndpoint: a.ResumableUploadEndpoint,
+			chunkSize:         chunkSize,
+			credentials:       a.UploadCredentials,
+		}, nil
+	}
+}
+
+// internalAPIDestination uploads to the internal API. Files larger than one chunk go through the resumable upload
+// protocol when a resumable endpoint is configured; others are streamed as a single multipart upload.
+type internalAPIDestination struct {
+	client            *http.Client
+	endpoint          string
+	resumableEndpoint string
+	chunkSize         int64
+	credentials       UploadCredentials
+}
+
+// Store uploads the file; the internal API stores every upload under a new ID and never replaces a stored file, so
+// overwrite is rejected
+func (d *internalAPIDestination) Store(ctx context.Context, fileName string, metadata UploadMetadata, overwrite bool) (UploadResult, error) {
+	if overwrite {
+		return UploadResult{}, errOverwriteUnsupported()
+	}
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return UploadResult{}, err
+	}
+	idempotencyKey := uploadIdempotencyKey(ctx, fileName)
+
+	if d.resumableEndpoint != "" && info.Size() > d.chunkSize {
+		return d.resumableUpload(ctx, fh, info.Size(), idempotencyKey, metadata)
+	}
+
+	progress := newProgressReader(fh)
+	body, formDataContentType := streamMultipartFile(progress, filepath.Base(fileName))
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint, body)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	req.Header.Set("Content-Type", formDataContentType)
+	setUploadHeaders(req, idempotencyKey, metadata)
+	d.authorize(ctx, req)
+
+	stop := heartbeatUntilStopped(ctx, func() interface{} { return UploadProgress{Offset: progress.BytesRead()} })
+	resp, err := d.client.Do(req)
+	stop()
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer resp.Body.Close()
+
+	// 201 stores a new upload, 200 returns the upload an earlier attempt stored with the same idempotency key
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return UploadResult{}, uploadResponseError("uploading file", resp)
+	}
+	return decodeUploadRecord(resp)
+}
+
+// authorize adds the credentials of the worker to a request; tokens are minted for the workflow being served
+func (d *internalAPIDestination) authorize(ctx context.Context, req *http.Request) {
+	d.credentials.authorize(req, activity.GetInfo(ctx).WorkflowExecution.ID, time.Now())
+}
+
+// setUploadHeaders identifies the upload and describes it for the catalog of the internal API
+func setUploadHeaders(req *http.Request, idempotencyKey string, metadata UploadMetadata) {
+	req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+	if metadata.DeviceID != "" {
+		req.Header.Set(DeviceIDHeader, metadata.DeviceID)
+	}
+	if metadata.WorkflowID != "" {
+		req.Header.Set(WorkflowIDHeader, metadata.WorkflowID)
+	}
+}
+
+// directoryDestination copies the output into a directory of the worker host, typically an NFS mount. The copy is
+// written under a temporary name and moved into place, so readers of the directory never see a partial file. A file
+// of the same name is only replaced with overwrite: otherwise the copy is hard linked into place, which fails
+// instead of replacing an existing file, and an existing file with the same content is taken as the copy of an
+// earlier attempt.
+type directoryDestination struct {
+	dir string
+}
+
+func (d *directoryDestination) Store(ctx context.Context, fileName string, _ UploadMetadata, overwrite bool) (UploadResult, error) {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return UploadResult{}, err
+	}
+	base := filepath.Base(fileName)
+	tmp, err := ioutil.TempFile(d.dir, "."+base+".*")
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	progress := newProgressReader(src)
+	stop := heartbeatUntilStopped(ctx, func() interface{} { return UploadProgress{Offset: progress.BytesRead()} })
+	defer stop()
+	size, err := io.Copy(tmp, progress)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	// the copy must be durable before it replaces the previous file
+	if err := tmp.Sync(); err != nil {
+		return UploadResult{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return UploadResult{}, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return UploadResult{}, err
+	}
+
+	target := filepath.Join(d.dir, base)
+	if overwrite {
+		if err := os.Rename(tmp.Name(), target); err != nil {
+			return UploadResult{}, err
+		}
+	} else if err := os.Link(tmp.Name(), target); err != nil {
+		if !os.IsExist(err) {
+			return UploadResult{}, err
+		}
+		same, err := sameContent(tmp.Name(), target)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		if !same {
+			return UploadResult{}, temporal.NewNonRetryableApplicationError(
+				fmt.Sprintf("%s already exists", target), ErrTypeOutputExists, nil)
+		}
+	}
+	location := url.URL{Scheme: DestinationSchemeFile, Path: filepath.ToSlash(target)}
+	return UploadResult{ID: base, FileName: base, Location: location.String(), Size: size}, nil
+}
+
+// sameContent reports whether both files have the same size and SHA-256 hash
+func sameContent(a string, b string) (bool, error) {
+	hashA, sizeA, err := fileSHA256(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, sizeB, err := fileSHA256(b)
+	if err != nil {
+		return false, err
+	}
+	return sizeA == sizeB && hashA == hashB, nil
+}
+
+func fileSHA256(fileName string) (string, int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
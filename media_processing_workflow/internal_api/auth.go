@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// authenticator admits the requests carrying one of the static API keys or an unexpired upload token signed with
+// the token secret. Without keys or secret every request is admitted.
+type authenticator struct {
+	apiKeys     [][]byte
+	tokenSecret []byte
+}
+
+func newAuthenticator(config AuthConfig) *authenticator {
+	a := &authenticator{}
+	for _, key := range config.APIKeys {
+		if key != "" {
+			a.apiKeys = append(a.apiKeys, []byte(key))
+		}
+	}
+	if config.TokenSecret != "" {
+		a.tokenSecret = []byte(config.TokenSecret)
+	}
+	return a
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.apiKeys) > 0 || a.tokenSecret != nil
+}
+
+// authenticate returns who made the request, or an error explaining why it is not admitted
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+	if key := r.Header.Get(media_processing_workflow.APIKeyHeader); key != "" {
+		for _, apiKey := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), apiKey) == 1 {
+				return "api key", nil
+			}
+		}
+		return "", fmt.Errorf("unknown API key")
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", fmt.Errorf("an upload token or API key is required")
+	}
+	if a.tokenSecret == nil {
+		return "", fmt.Errorf("upload tokens are not accepted")
+	}
+	claims, err := media_processing_workflow.VerifyUploadToken(a.tokenSecret, strings.TrimPrefix(authorization, "Bearer "), time.Now())
+	if err != nil {
+		return "", err
+	}
+	return "token for " + claims.Subject, nil
+}
+
+// require wraps a handler so that it only serves authenticated requests; others are answered 401
+func (a *authenticator) require(next http.HandlerFunc) http.HandlerFunc {
+	if !a.enabled() {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		who, err := a.authenticate(r)
+		if err != nil {
+			fmt.Printf("Unauthorized %s %s from %s: %v\n", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="internal_api"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized: "+err.Error()+".")
+			return
+		}
+		fmt.Printf("%s %s authenticated with %s\n", r.Method, r.URL.Path, who)
+		next(w, r)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// maxJournalEntries is how many changes the journal of the catalog holds before it is folded into the snapshot
+const maxJournalEntries = 1000
+
+// catalog records every stored upload. The records are held in memory; on disk, a json snapshot of the records is
+// followed by a journal of the changes made since, one json line per change. put and remove append their change to
+// the journal and sync it, so a change is on disk once they return, at a cost that does not grow with the number of
+// uploads. The journal is folded into the snapshot when the catalog is opened and every maxJournalEntries changes.
+type catalog struct {
+	path        string
+	journalPath string
+
+	mu      sync.RWMutex
+	records map[string]media_processing_workflow.UploadRecord
+	// journalEntries is the number of changes in the journal
+	journalEntries int
+}
+
+// catalogChange is a line of the journal: a record put in the catalog or the ID of a removed record
+type catalogChange struct {
+	Put    *media_processing_workflow.UploadRecord `json:"put,omitempty"`
+	Remove string                                  `json:"remove,omitempty"`
+}
+
+func openCatalog(path string) (*catalog, error) {
+	c := &catalog{
+		path:        path,
+		journalPath: strings.TrimSuffix(path, filepath.Ext(path)) + ".journal",
+		records:     map[string]media_processing_workflow.UploadRecord{},
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var records []media_processing_workflow.UploadRecord
+		if err := json.Unmarshal(b, &records); err != nil {
+			return nil, fmt.Errorf("reading catalog %s: %v", path, err)
+		}
+		for _, record := range records {
+			c.records[record.ID] = record
+		}
+	}
+
+	journal, err := ioutil.ReadFile(c.journalPath)
+	if os.IsNotExist(err) {
+		// created durably once, so that appending to it only has to sync the journal itself
+		return c, writeFileDurably(c.journalPath, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(journal) == 0 {
+		return c, nil
+	}
+	lines := bytes.Split(journal, []byte("\n"))
+	// a crash while appending leaves the last line without its newline; that change was never acknowledged
+	for i, line := range lines[:len(lines)-1] {
+		var change catalogChange
+		if err := json.Unmarshal(line, &change); err != nil {
+			return nil, fmt.Errorf("reading line %d of catalog journal %s: %v", i+1, c.journalPath, err)
+		}
+		c.apply(change)
+	}
+	// the changes are applied again to the snapshot if compacting stops before the journal is emptied
+	return c, c.compact()
+}
+
+// apply makes the change to the records in memory; the caller holds the write lock or has not shared c yet
+func (c *catalog) apply(change catalogChange) {
+	if change.Put != nil {
+		c.records[change.Put.ID] = *change.Put
+	} else {
+		delete(c.records, change.Remove)
+	}
+}
+
+func (c *catalog) get(id string) (media_processing_workflow.UploadRecord, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	record, ok := c.records[id]
+	return record, ok
+}
+
+// put adds or replaces the record and persists the change
+func (c *catalog) put(record media_processing_workflow.UploadRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.persist(catalogChange{Put: &record})
+}
+
+// remove deletes the record and persists the change
+func (c *catalog) remove(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.records[id]; !ok {
+		return nil
+	}
+	return c.persist(catalogChange{Remove: id})
+}
+
+// persist appends the change to the journal and applies it once it is on disk; the caller holds the write lock
+func (c *catalog) persist(change catalogChange) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if err := appendFileDurably(c.journalPath, append(line, '\n')); err != nil {
+		return err
+	}
+	c.apply(change)
+
+	c.journalEntries++
+	if c.journalEntries >= maxJournalEntries {
+		// the change is already on disk; the journal is folded into the snapshot again with the next change
+		if err := c.compact(); err != nil {
+			fmt.Println("Unable to compact the catalog:", err)
+		}
+	}
+	return nil
+}
+
+// usage returns the number and total size of the files recorded for the device
+func (c *catalog) usage(deviceID string) (files int, bytes int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, record := range c.records {
+		if record.DeviceID == deviceID {
+			files++
+			bytes += record.Size
+		}
+	}
+	return files, bytes
+}
+
+// list returns the records matching the non-empty filters, most recent upload first
+func (c *catalog) list(deviceID string, workflowID string) []media_processing_workflow.UploadRecord {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	records := []media_processing_workflow.UploadRecord{}
+	for _, record := range c.records {
+		if deviceID != "" && record.DeviceID != deviceID {
+			continue
+		}
+		if workflowID != "" && record.WorkflowID != workflowID {
+			continue
+		}
+		records = append(records, record)
+	}
+	sortRecords(records)
+	return records
+}
+
+// compact writes the records to the snapshot, then empties the journal; the caller holds the write lock or has not
+// shared c yet
+func (c *catalog) compact() error {
+	records := make([]media_processing_workflow.UploadRecord, 0, len(c.records))
+	for _, record := range c.records {
+		records = append(records, record)
+	}
+	sortRecords(records)
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileDurably(c.path, b); err != nil {
+		return err
+	}
+	if err := writeFileDurably(c.journalPath, nil); err != nil {
+		return err
+	}
+	c.journalEntries = 0
+	return nil
+}
+
+// appendFileDurably appends data to the file at path, creating it if needed, and syncs the file before returning.
+// A failed append is cut off again, so that the next append starts on a line of its own.
+func appendFileDurably(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			f.Truncate(info.Size())
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFileDurably replaces the file at path with data. The data is synced before the temporary file is renamed
+// into place, and the directory after, so that the file holds either the old or the new data after a crash.
+func writeFileDurably(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func sortRecords(records []media_processing_workflow.UploadRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].UploadedAt.Equal(records[j].UploadedAt) {
+			return records[i].UploadedAt.After(records[j].UploadedAt)
+		}
+		return records[i].ID < records[j].ID
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Catalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".catalog.json")
+
+	c, err := openCatalog(path)
+	require.NoError(t, err)
+	assert.Empty(t, c.list("", ""))
+
+	uploadedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := media_processing_workflow.UploadRecord{ID: "a", DeviceID: "device-1", WorkflowID: "wf-1", Size: 10, UploadedAt: uploadedAt}
+	second := media_processing_workflow.UploadRecord{ID: "b", DeviceID: "device-1", WorkflowID: "wf-2", Size: 20, UploadedAt: uploadedAt.Add(time.Minute)}
+	third := media_processing_workflow.UploadRecord{ID: "c", DeviceID: "device-2", Size: 40, UploadedAt: uploadedAt}
+	for _, record := range []media_processing_workflow.UploadRecord{first, second, third} {
+		require.NoError(t, c.put(record))
+	}
+	assert.NoFileExists(t, path+".tmp")
+
+	record, ok := c.get("b")
+	assert.True(t, ok)
+	assert.Equal(t, second, record)
+	_, ok = c.get("d")
+	assert.False(t, ok)
+
+	// most recent first, ties broken by ID
+	assert.Equal(t, []media_processing_workflow.UploadRecord{second, first, third}, c.list("", ""))
+	assert.Equal(t, []media_processing_workflow.UploadRecord{second, first}, c.list("device-1", ""))
+	assert.Equal(t, []media_processing_workflow.UploadRecord{first}, c.list("device-1", "wf-1"))
+	files, bytes := c.usage("device-1")
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(30), bytes)
+
+	require.NoError(t, c.remove("a"))
+	require.NoError(t, c.remove("a"))
+
+	reopened, err := openCatalog(path)
+	require.NoError(t, err)
+	assert.Equal(t, []media_processing_workflow.UploadRecord{second, third}, reopened.list("", ""))
+}
+
+func Test_Catalog_FailedSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".catalog.json")
+
+	c, err := openCatalog(path)
+	require.NoError(t, err)
+	record := media_processing_workflow.UploadRecord{ID: "a", Size: 10}
+	require.NoError(t, c.put(record))
+
+	// the catalog cannot be written once its directory is gone; the records in memory stay as they are on disk
+	require.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, c.put(media_processing_workflow.UploadRecord{ID: "b"}))
+	assert.Error(t, c.put(media_processing_workflow.UploadRecord{ID: "a", Size: 20}))
+	assert.Error(t, c.remove("a"))
+	assert.Equal(t, []media_processing_workflow.UploadRecord{record}, c.list("", ""))
+}
+
+func Test_OpenCatalog_Corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".catalog.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("[{"), 0644))
+
+	_, err = openCatalog(path)
+	assert.Error(t, err)
+}
+
+func Test_Catalog_Journal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".catalog.json")
+
+	c, err := openCatalog(path)
+	require.NoError(t, err)
+	first := media_processing_workflow.UploadRecord{ID: "a", Size: 10}
+	second := media_processing_workflow.UploadRecord{ID: "b", Size: 20}
+	require.NoError(t, c.put(first))
+	require.NoError(t, c.put(second))
+	require.NoError(t, c.remove("a"))
+
+	// changes are appended to the journal without rewriting the snapshot
+	assert.NoFileExists(t, path)
+	journal, err := ioutil.ReadFile(c.journalPath)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(journal), "\n"))
+
+	// a change cut off by a crash was never acknowledged and is dropped
+	f, err := os.OpenFile(c.journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"put":{"id":"c"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// reopening folds the journal into the snapshot
+	reopened, err := openCatalog(path)
+	require.NoError(t, err)
+	assert.Equal(t, []media_processing_workflow.UploadRecord{second}, reopened.list("", ""))
+	assert.FileExists(t, path)
+	journal, err = ioutil.ReadFile(c.journalPath)
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+
+	// and so does a journal reaching maxJournalEntries
+	for i := 0; i < maxJournalEntries; i++ {
+		require.NoError(t, reopened.put(media_processing_workflow.UploadRecord{ID: fmt.Sprintf("r%d", i)}))
+	}
+	assert.Zero(t, reopened.journalEntries)
+	journal, err = ioutil.ReadFile(c.journalPath)
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+	compacted, err := openCatalog(path)
+	require.NoError(t, err)
+	assert.Len(t, compacted.list("", ""), maxJournalEntries+1)
+}
+
+func Test_OpenCatalog_CorruptJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".catalog.journal"), []byte("{\n{\"remove\":\"a\"}\n"), 0644))
+
+	_, err = openCatalog(filepath.Join(dir, ".catalog.json"))
+	assert.EqualError(t, err, fmt.Sprintf("reading line 1 of catalog journal %s: unexpected end of JSON input", filepath.Join(dir, ".catalog.journal")))
+}
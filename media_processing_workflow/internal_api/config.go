@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaults of the settings missing from the config file
+const (
+	defaultPort              = "9220"
+	defaultStorageDir        = "uploadedfiles"
+	defaultMaxUploadSize     = 500 * 1024 * 1024 // 500 MB
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Minute
+	defaultWriteTimeout      = 30 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultShutdownTimeout   = 5 * time.Minute
+	defaultWebhookAttempts   = 5
+	defaultWebhookRetry      = time.Second
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultJanitorInterval   = time.Hour
+	defaultResumableExpiry   = 24 * time.Hour
+	// eventStreamMargin is how long before the write timeout of the server an /events stream ends by default
+	eventStreamMargin = 10 * time.Second
+)
+
+// InternalConfig struct
+type InternalConfig struct {
+	Server     ServerConfig     `yaml:"server"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Validation ValidationConfig `yaml:"validation"`
+	Events     EventsConfig     `yaml:"events"`
+}
+
+// ServerConfig configures the http server. The read and write timeouts bound a whole request, so they must leave
+// time for the largest upload on the slowest link.
+type ServerConfig struct {
+	Host string `yaml:"host"`
+	Port string `yaml:"port"`
+	// TLS serves https when both the certificate and key files are set
+	TLS struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+	} `yaml:"tls"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests may take to complete once the server is asked to stop
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	MaxHeaderBytes  int           `yaml:"max_header_bytes"`
+}
+
+// StorageConfig configures where and how much is stored
+type StorageConfig struct {
+	// Dir holds the uploaded files, their catalog and the resumable uploads in progress
+	Dir string `yaml:"dir"`
+	// MaxUploadSize is the largest accepted upload in bytes
+	MaxUploadSize int64           `yaml:"max_upload_size"`
+	Quotas        QuotaConfig     `yaml:"quotas"`
+	Retention     RetentionConfig `yaml:"retention"`
+	// ResumableExpiry is how long a resumable upload is kept after its last request, so that abandoned uploads
+	// do not fill the disk; negative keeps them forever
+	ResumableExpiry time.Duration `yaml:"resumable_expiry"`
+}
+
+// QuotaConfig limits the bytes stored per device; uploads that would exceed the quota of their device are rejected.
+// Uploads without a device ID are not subject to quotas.
+type QuotaConfig struct {
+	// DefaultDeviceBytes is the quota of the devices not listed in Devices; zero is unlimited
+	DefaultDeviceBytes int64 `yaml:"default_device_bytes"`
+	// Devices maps device IDs to their quota in bytes; zero is unlimited
+	Devices map[string]int64 `yaml:"devices"`
+}
+
+// RetentionConfig selects the stored uploads the janitor deletes: those older than MaxAge, then the oldest
+// uploads until the rest fit in MaxTotalSize. Zero disables the respective rule.
+type RetentionConfig struct {
+	MaxAge          time.Duration `yaml:"max_age"`
+	MaxTotalSize    int64         `yaml:"max_total_size"`
+	JanitorInterval time.Duration `yaml:"janitor_interval"`
+}
+
+// AuthConfig holds the credentials accepted for every endpoint. Requests are not authenticated when neither API keys
+// nor a token secret are configured.
+type AuthConfig struct {
+	// APIKeys are static keys sent in the X-Api-Key header
+	APIKeys []string `yaml:"api_keys"`
+	// TokenSecret is the HMAC key of the expiring upload tokens sent as bearer tokens
+	TokenSecret string `yaml:"token_secret"`
+}
+
+// ValidationConfig holds the rules an upload must satisfy to be stored. An empty list allows any value.
+type ValidationConfig struct {
+	// Enabled probes every upload with ffprobe before it is stored
+	Enabled bool `yaml:"enabled"`
+	// AllowedContainers are ffprobe format names, e.g. mp4 or mov
+	AllowedContainers  []string `yaml:"allowed_containers"`
+	AllowedVideoCodecs []string `yaml:"allowed_video_codecs"`
+	AllowedAudioCodecs []string `yaml:"allowed_audio_codecs"`
+	// RequireVideo rejects files without a video stream; audio-only outputs of the workflow have none
+	RequireVideo bool `yaml:"require_video"`
+	// MaxDurationSeconds is the longest accepted media; zero accepts any duration
+	MaxDurationSeconds float64 `yaml:"max_duration_seconds"`
+}
+
+// EventsConfig configures the delivery of the upload events to webhooks
+type EventsConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// MaxAttempts is how often a delivery is attempted before the event is dropped for the webhook
+	MaxAttempts int `yaml:"max_attempts"`
+	// RetryInterval is the wait before the first retry; it doubles with every further retry
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	// Timeout bounds a single delivery
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxStreamDuration ends an /events stream cleanly before the write timeout of the server cuts it off; clients
+	// reconnect with Last-Event-ID to receive the events published in between. It defaults to shortly before the
+	// write timeout and must be below it.
+	MaxStreamDuration time.Duration `yaml:"max_stream_duration"`
+}
+
+// WebhookConfig is a URL the upload events are posted to
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs the deliveries in the X-Webhook-Signature header; unsigned when empty
+	Secret string `yaml:"secret"`
+}
+
+// NewInternalConfig returns a struct composed of internal api config info
+func NewInternalConfig(configPath string) (*InternalConfig, error) {
+
+	config := &InternalConfig{}
+
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	d := yaml.NewDecoder(file)
+
+	if err := d.Decode(&config); err != nil {
+		return nil, err
+	}
+	config.setDefaults()
+
+	if (config.Server.TLS.CertFile == "") != (config.Server.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("'%s' must set both the TLS cert_file and key_file, or neither", configPath)
+	}
+	for _, webhook := range config.Events.Webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("'%s' lists webhook %q, which is not an http(s) URL", configPath, webhook.URL)
+		}
+	}
+	if config.Server.WriteTimeout > 0 && config.Events.MaxStreamDuration >= config.Server.WriteTimeout {
+		return nil, fmt.Errorf("'%s' sets a max_stream_duration that is not below the write_timeout", configPath)
+	}
+	if config.Storage.MaxUploadSize < 0 {
+		return nil, fmt.Errorf("'%s' sets a negative max_upload_size", configPath)
+	}
+	if config.Storage.Retention.MaxAge < 0 || config.Storage.Retention.MaxTotalSize < 0 {
+		return nil, fmt.Errorf("'%s' sets a negative retention limit", configPath)
+	}
+
+	return config, nil
+}
+
+func (c *InternalConfig) setDefaults() {
+	if c.Server.Port == "" {
+		c.Server.Port = defaultPort
+	}
+	if c.Server.ReadHeaderTimeout == 0 {
+		c.Server.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.Server.ReadTimeout == 0 {
+		c.Server.ReadTimeout = defaultReadTimeout
+	}
+	if c.Server.WriteTimeout == 0 {
+		c.Server.WriteTimeout = defaultWriteTimeout
+	}
+	if c.Server.IdleTimeout == 0 {
+		c.Server.IdleTimeout = defaultIdleTimeout
+	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.Events.MaxAttempts <= 0 {
+		c.Events.MaxAttempts = defaultWebhookAttempts
+	}
+	if c.Events.RetryInterval == 0 {
+		c.Events.RetryInterval = defaultWebhookRetry
+	}
+	if c.Events.Timeout == 0 {
+		c.Events.Timeout = defaultWebhookTimeout
+	}
+	if c.Events.MaxStreamDuration <= 0 {
+		c.Events.MaxStreamDuration = eventStreamDuration(c.Server.WriteTimeout)
+	}
+	if c.Storage.Dir == "" {
+		c.Storage.Dir = defaultStorageDir
+	}
+	if c.Storage.MaxUploadSize == 0 {
+		c.Storage.MaxUploadSize = defaultMaxUploadSize
+	}
+	if c.Storage.Retention.JanitorInterval <= 0 {
+		c.Storage.Retention.JanitorInterval = defaultJanitorInterval
+	}
+	if c.Storage.ResumableExpiry == 0 {
+		c.Storage.ResumableExpiry = defaultResumableExpiry
+	}
+}
+
+// ValidateConfigPath ..
+func ValidateConfigPath(configPath string) error {
+	s, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	if s.IsDir() {
+		return fmt.Errorf("'%s' file is not a regular file; please verify", configPath)
+	}
+	return nil
+}
+
+// eventStreamDuration returns how long an /events stream lasts by default with the write timeout of the server
+func eventStreamDuration(writeTimeout time.Duration) time.Duration {
+	if writeTimeout <= 2*eventStreamMargin {
+		return writeTimeout / 2
+	}
+	return writeTimeout - eventStreamMargin
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// recentEventCount is how many events are kept to replay to reconnecting /events clients
+	recentEventCount = 100
+	// subscriberBuffer is how many events a slow /events client may fall behind before it is disconnected
+	subscriberBuffer = 64
+	// webhookQueueSize is how many events may wait for delivery to a single webhook
+	webhookQueueSize = 1000
+	// maxWebhookRetryInterval caps the doubling interval between delivery attempts
+	maxWebhookRetryInterval = time.Minute
+	// eventStreamKeepAlive is how often an idle /events stream receives a comment, so proxies keep it open
+	eventStreamKeepAlive = 30 * time.Second
+)
+
+// eventBus emits an event for every stored upload to the configured webhooks and the /events subscribers.
+// Events are kept in memory only: events emitted while a webhook stays unreachable past its last retry, or while
+// the internal API is down, are lost, and receivers should fall back to GET /media to catch up.
+type eventBus struct {
+	webhooks []*webhook
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	// maxStreamDuration ends the /events streams before the write timeout of the server; zero never ends them
+	maxStreamDuration time.Duration
+
+	mu            sync.Mutex
+	subscribers   map[chan media_processing_workflow.UploadEvent]struct{}
+	recent        []media_processing_workflow.UploadEvent
+	streamsClosed bool
+	closed        bool
+}
+
+func newEventBus(config EventsConfig) *eventBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &eventBus{
+		cancel:            cancel,
+		maxStreamDuration: config.MaxStreamDuration,
+		subscribers:       map[chan media_processing_workflow.UploadEvent]struct{}{},
+	}
+	client := &http.Client{Timeout: config.Timeout}
+	for _, c := range config.Webhooks {
+		w := newWebhook(c, config, client)
+		b.webhooks = append(b.webhooks, w)
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			w.run(ctx)
+		}()
+	}
+	return b
+}
+
+// publish emits the upload completed event of the record; it never blocks on slow receivers
+func (b *eventBus) publish(record media_processing_workflow.UploadRecord) {
+	event := media_processing_workflow.UploadEvent{
+		ID:        uuid.New(),
+		Type:      media_processing_workflow.UploadCompletedEvent,
+		CreatedAt: time.Now().UTC(),
+		Record:    record,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.recent = append(b.recent, event)
+	if len(b.recent) > recentEventCount {
+		b.recent = b.recent[len(b.recent)-recentEventCount:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// the client is not keeping up; it is disconnected and can reconnect with Last-Event-ID
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	for _, w := range b.webhooks {
+		select {
+		case w.queue <- event:
+		default:
+			fmt.Printf("Dropped event %s for webhook %s: its queue is full\n", event.ID, w.config.URL)
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events published from now on, preceded by the recent events
+// published after the event lastEventID, if it is still known
+func (b *eventBus) subscribe(lastEventID string) chan media_processing_workflow.UploadEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan media_processing_workflow.UploadEvent, subscriberBuffer+recentEventCount)
+	if b.streamsClosed {
+		close(ch)
+		return ch
+	}
+	if lastEventID != "" {
+		for i, event := range b.recent {
+			if event.ID == lastEventID {
+				for _, missed := range b.recent[i+1:] {
+					ch <- missed
+				}
+				break
+			}
+		}
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan media_processing_workflow.UploadEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// closeStreams ends the /events streams, so that they do not hold up the shutdown of the server
+func (b *eventBus) closeStreams() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.streamsClosed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// drain stops emitting events and waits for the pending webhook deliveries to complete; the deliveries still
+// pending when ctx is done are abandoned
+func (b *eventBus) drain(ctx context.Context) {
+	b.mu.Lock()
+	b.closed = true
+	for _, w := range b.webhooks {
+		close(w.queue)
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		b.cancel()
+		<-done
+	}
+}
+
+// eventsHandler handles GET /events, a server-sent events stream of the upload events. The stream ends after
+// maxStreamDuration; a client reconnecting with the Last-Event-ID header first receives the recent events it missed.
+func (b *eventBus) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported.")
+		return
+	}
+	events := b.subscribe(r.Header.Get("Last-Event-ID"))
+	defer b.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	// ending the response cleanly lets EventSource clients reconnect with Last-Event-ID, where being cut off by the
+	// write timeout looks like a broken stream
+	var streamEnd <-chan time.Time
+	if b.maxStreamDuration > 0 {
+		timer := time.NewTimer(b.maxStreamDuration)
+		defer timer.Stop()
+		streamEnd = timer.C
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-streamEnd:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// webhook delivers the events to a single URL in order
+type webhook struct {
+	config WebhookConfig
+	sender *media_processing_workflow.WebhookSender
+	queue  chan media_processing_workflow.UploadEvent
+}
+
+func newWebhook(c WebhookConfig, config EventsConfig, client *http.Client) *webhook {
+	return &webhook{
+		config: c,
+		sender: &media_processing_workflow.WebhookSender{
+			URL:              c.URL,
+			Secret:           c.Secret,
+			Client:           client,
+			MaxAttempts:      config.MaxAttempts,
+			RetryInterval:    config.RetryInterval,
+			MaxRetryInterval: maxWebhookRetryInterval,
+			OnRetry: func(id string, attempt int, wait time.Duration, err error) {
+				fmt.Printf("Delivering event %s to webhook %s failed, retrying in %s: %v\n", id, c.URL, wait, err)
+			},
+		},
+		queue: make(chan media_processing_workflow.UploadEvent, webhookQueueSize),
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	abandoned := 0
+	for event := range w.queue {
+		if ctx.Err() != nil {
+			abandoned++
+			continue
+		}
+		w.deliver(ctx, event)
+	}
+	if abandoned > 0 {
+		fmt.Printf("Abandoned %d events for webhook %s\n", abandoned, w.config.URL)
+	}
+}
+
+func (w *webhook) deliver(ctx context.Context, event media_processing_workflow.UploadEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := w.sender.Deliver(ctx, event.ID, body); err != nil {
+		if ctx.Err() != nil {
+			fmt.Printf("Abandoned event %s for webhook %s\n", event.ID, w.config.URL)
+			return
+		}
+		fmt.Printf("Giving up on event %s for webhook %s: %v\n", event.ID, w.config.URL, err)
+	}
+}
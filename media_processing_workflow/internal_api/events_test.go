@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads the next server-sent event of the stream, skipping keep-alive comments
+func readEvent(t *testing.T, stream *bufio.Reader) (id string, eventType string, event media_processing_workflow.UploadEvent) {
+	for {
+		line, err := stream.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		case line == "" && id != "":
+			return id, eventType, event
+		}
+	}
+}
+
+func Test_EventsHandler(t *testing.T) {
+	server, _ := newTestServer(t, StorageConfig{}, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	stream := bufio.NewReader(resp.Body)
+
+	var records []media_processing_workflow.UploadRecord
+	var ids []string
+	for _, contents := range []string{"first", "second"} {
+		upload := postMultipart(t, server.URL, contents, nil)
+		var record media_processing_workflow.UploadRecord
+		decodeResponse(t, upload, &record)
+		records = append(records, record)
+
+		id, eventType, event := readEvent(t, stream)
+		assert.Equal(t, media_processing_workflow.UploadCompletedEvent, eventType)
+		assert.Equal(t, id, event.ID)
+		assert.Equal(t, record, event.Record)
+		ids = append(ids, id)
+	}
+
+	// a reconnecting client receives the events published after the last one it saw
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", ids[0])
+	resumed, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resumed.Body.Close()
+	id, _, event := readEvent(t, bufio.NewReader(resumed.Body))
+	assert.Equal(t, ids[1], id)
+	assert.Equal(t, records[1], event.Record)
+}
+
+func Test_EventsHandler_StreamEnds(t *testing.T) {
+	assert.Equal(t, 30*time.Minute-10*time.Second, eventStreamDuration(30*time.Minute))
+	assert.Equal(t, 5*time.Second, eventStreamDuration(10*time.Second))
+
+	writeTimeout := 500 * time.Millisecond
+	events := newEventBus(EventsConfig{MaxStreamDuration: eventStreamDuration(writeTimeout)})
+	defer events.closeStreams()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(events.eventsHandler))
+	server.Config.WriteTimeout = writeTimeout
+	server.Start()
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// the stream ends cleanly before the write timeout would cut it off
+	_, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < writeTimeout, time.Since(start))
+}
+
+func Test_EventBus_Webhooks(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	var mu sync.Mutex
+	deliveries := map[string][]delivery{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		deliveries[r.URL.Path] = append(deliveries[r.URL.Path], delivery{header: r.Header, body: body})
+		attempt := len(deliveries[r.URL.Path])
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/flaky" && attempt == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/rejecting":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer receiver.Close()
+
+	events := newEventBus(EventsConfig{
+		Webhooks: []WebhookConfig{
+			{URL: receiver.URL + "/flaky", Secret: "secret"},
+			{URL: receiver.URL + "/rejecting"},
+		},
+		MaxAttempts:   3,
+		RetryInterval: 10 * time.Millisecond,
+		Timeout:       time.Second,
+	})
+	record := media_processing_workflow.UploadRecord{ID: "upload-1", FileName: storedFileName("upload-1")}
+	events.publish(record)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events.drain(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, deliveries["/flaky"], 2)
+	assert.Len(t, deliveries["/rejecting"], 1)
+	for _, d := range deliveries["/flaky"] {
+		var event media_processing_workflow.UploadEvent
+		require.NoError(t, json.Unmarshal(d.body, &event))
+		assert.Equal(t, record, event.Record)
+		assert.Equal(t, event.ID, d.header.Get(media_processing_workflow.WebhookIDHeader))
+		assert.NoError(t, media_processing_workflow.VerifyPayloadSignature([]byte("secret"), d.body,
+			d.header.Get(media_processing_workflow.WebhookTimestampHeader), d.header.Get(media_processing_workflow.WebhookSignatureHeader),
+			time.Now(), media_processing_workflow.DefaultWebhookTolerance))
+	}
+	// the retry redelivers the same event
+	assert.Equal(t, deliveries["/flaky"][0].body, deliveries["/flaky"][1].body)
+	assert.Empty(t, deliveries["/rejecting"][0].header.Get(media_processing_workflow.WebhookSignatureHeader))
+}
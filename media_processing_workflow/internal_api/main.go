@@ -1,65 +1,120 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/gorilla/mux"
 )
 
+func parseFlags() (string, error) {
+	var configPath string
 
-const MAX_UPLOAD_SIZE = 500 * 1024 * 1024 // 500 MB
+	flag.StringVar(&configPath, "config", "./config.yaml", "the path to the internal api config file. Defaults to the config.yaml file")
 
+	flag.Parse()
 
-func uploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateConfigPath(configPath); err != nil {
+		return "", err
+	}
+
+	return configPath, nil
+}
+
+// newRouter routes the endpoints of the internal API; every endpoint requires authentication once it is configured
+func newRouter(auth *authenticator, uploads *uploadStore, resumable *resumableStore, events *eventBus) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/uploadmedia", auth.require(uploads.uploadMediaHandler))
+	r.HandleFunc("/uploads", auth.require(resumable.createUploadHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/uploads/{id}", auth.require(resumable.uploadOffsetHandler)).Methods(http.MethodHead)
+	r.HandleFunc("/uploads/{id}", auth.require(resumable.appendChunkHandler)).Methods(http.MethodPatch)
+	r.HandleFunc("/media", auth.require(uploads.listMediaHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/media/{id}", auth.require(uploads.mediaHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/media/{id}/content", auth.require(uploads.mediaContentHandler)).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/events", auth.require(events.eventsHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/retention/report", auth.require(uploads.retentionReportHandler)).Methods(http.MethodGet)
+	return r
+}
 
-	if r.Method != "POST" {
-		http.Error(w, "Only POST Method is permitted", http.StatusMethodNotAllowed)
-		return
+func main() {
+	configPath, err := parseFlags()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if err := r.ParseMultipartForm(MAX_UPLOAD_SIZE); err != nil {
-		http.Error(w, "The uploaded file is too big.", http.StatusBadRequest)
-		return
+	cfg, err := NewInternalConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-    multipartFile, multipartFileHeader, err := r.FormFile(media_processing_workflow.FileNameAttribute)
-    if err != nil {
-        fmt.Println("Error Retrieving the File")
-        fmt.Println(err)
-		http.Error(w, "Error Retrieving the File.", http.StatusInternalServerError)
-        return
-    }
-    defer multipartFile.Close()
-    fmt.Printf("Uploaded File Name: %+v\n", multipartFileHeader.Filename)
-    fmt.Printf("File Size bytes: %+v\n", multipartFileHeader.Size)
-    fmt.Printf("MIME Header: %+v\n", multipartFileHeader.Header)
-
-	// The uploaded files are stored within the `uploadedfiles` directory inside the internal_api
-    tmpFile, err := ioutil.TempFile("uploadedfiles", "video-*.mp4")
-    if err != nil {
-        fmt.Println(err)
-    }
-    defer tmpFile.Close()
-
-    fileBytes, err := ioutil.ReadAll(multipartFile)
-    if err != nil {
-		http.Error(w, "Error reading the contents of the uploaded file.", http.StatusInternalServerError)
-        fmt.Println(err)
-    }
-
-	_, err = tmpFile.Write(fileBytes)
+	events := newEventBus(cfg.Events)
+	uploads, err := newUploadStore(cfg.Storage, cfg.Validation, events)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resumable, err := newResumableStore(uploads, cfg.Storage.ResumableExpiry)
 	if err != nil {
-		http.Error(w, "Error writing the contents of the uploaded file.", http.StatusInternalServerError)
+		log.Fatal(err)
 	}
 
-	fmt.Fprintf(w, "File Uploaded.\n")
-}
+	auth := newAuthenticator(cfg.Auth)
+	if !auth.enabled() {
+		fmt.Println("No API keys or token secret configured; requests are not authenticated")
+	}
 
+	r := newRouter(auth, uploads, resumable, events)
 
-func main() {
-	fmt.Println("Starting internal API server...")
-	http.HandleFunc("/uploadmedia", uploadMediaHandler)
-	_ = http.ListenAndServe(":9220", nil)
+	server := &http.Server{
+		Addr:              net.JoinHostPort(cfg.Server.Host, cfg.Server.Port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
+	server.RegisterOnShutdown(events.closeStreams)
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	go uploads.runJanitor(janitorCtx)
+	go resumable.runJanitor(janitorCtx, cfg.Storage.Retention.JanitorInterval)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Starting internal API server on %s...\n", server.Addr)
+		if cfg.Server.TLS.CertFile != "" {
+			serveErr <- server.ListenAndServeTLS(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-stop:
+		fmt.Printf("Received %s; waiting up to %s for in-flight requests to complete...\n", sig, cfg.Server.ShutdownTimeout)
+	}
+	stopJanitor()
+
+	// new connections are refused while the in-flight uploads are drained; uploads still running when the timeout
+	// expires are cut off and can be resumed or retried by the client
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Shutdown incomplete:", err)
+		server.Close()
+	}
+	// the events of the drained uploads are still delivered
+	events.drain(ctx)
+	fmt.Println("Internal API server stopped")
 }
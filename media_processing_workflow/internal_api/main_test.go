@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAPIKey = "test-key"
+
+// newTestServer serves the routes of the internal API over a test store, requiring testAPIKey when auth is set
+func newTestServer(t *testing.T, storage StorageConfig, auth bool) (*httptest.Server, *uploadStore) {
+	uploads := newTestStore(t, storage)
+	resumable, err := newResumableStore(uploads, time.Hour)
+	require.NoError(t, err)
+	config := AuthConfig{}
+	if auth {
+		config.APIKeys = []string{testAPIKey}
+	}
+	server := httptest.NewServer(newRouter(newAuthenticator(config), uploads, resumable, uploads.events))
+	t.Cleanup(server.Close)
+	return server, uploads
+}
+
+func Test_Router_RequiresAuthentication(t *testing.T) {
+	server, _ := newTestServer(t, StorageConfig{}, true)
+
+	for _, endpoint := range []struct{ method, path string }{
+		{http.MethodPost, "/uploadmedia"},
+		{http.MethodPost, "/uploads"},
+		{http.MethodHead, "/uploads/0b7a6c63-5d3e-4c3b-8a34-1c0d4a5f6e7d"},
+		{http.MethodPatch, "/uploads/0b7a6c63-5d3e-4c3b-8a34-1c0d4a5f6e7d"},
+		{http.MethodGet, "/media"},
+		{http.MethodGet, "/media/0b7a6c63-5d3e-4c3b-8a34-1c0d4a5f6e7d"},
+		{http.MethodGet, "/media/0b7a6c63-5d3e-4c3b-8a34-1c0d4a5f6e7d/content"},
+		{http.MethodHead, "/media/0b7a6c63-5d3e-4c3b-8a34-1c0d4a5f6e7d/content"},
+		{http.MethodGet, "/events"},
+		{http.MethodGet, "/retention/report"},
+	} {
+		req, err := http.NewRequest(endpoint.method, server.URL+endpoint.path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "%s %s", endpoint.method, endpoint.path)
+	}
+
+	for path, status := range map[string]int{
+		"/media": http.StatusOK,
+		"/media/0b7a6c63-5d3e-4c3b-8a34-1c0d4a5f6e7d": http.StatusNotFound,
+		"/retention/report":                           http.StatusOK,
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set(media_processing_workflow.APIKeyHeader, testAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, path)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+)
+
+// listMediaHandler handles GET /media, optionally filtered by the deviceId and workflowId query parameters
+func (s *uploadStore) listMediaHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	writeJSON(w, http.StatusOK, s.catalog.list(query.Get("deviceId"), query.Get("workflowId")))
+}
+
+// mediaHandler handles GET /media/{id}
+func (s *uploadStore) mediaHandler(w http.ResponseWriter, r *http.Request) {
+	record, err := s.record(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Media not found.")
+		return
+	}
+	writeRecord(w, http.StatusOK, record)
+}
+
+// mediaContentHandler handles GET /media/{id}/content. Range and conditional requests are answered by
+// http.ServeContent, with the hash of the file as its ETag.
+func (s *uploadStore) mediaContentHandler(w http.ResponseWriter, r *http.Request) {
+	record, err := s.record(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Media not found.")
+		return
+	}
+	f, err := os.Open(s.path(record))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Media not found.")
+		return
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(record.FileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+record.SHA256+`"`)
+	http.ServeContent(w, r, record.FileName, record.UploadedAt, f)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// quotaExceededError rejects an upload that would take the storage of its device over quota. The usage counts the
+// stored files of the device and the Upload-Length of its resumable uploads in progress.
+type quotaExceededError struct {
+	deviceID string
+	quota    int64
+	usage    int64
+	size     int64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("device %s stores %d bytes; %d more would exceed its quota of %d bytes", e.deviceID, e.usage, e.size, e.quota)
+}
+
+// quota returns the quota of the device in bytes; zero is unlimited
+func (c QuotaConfig) quota(deviceID string) int64 {
+	if deviceID == "" {
+		return 0
+	}
+	if quota, ok := c.Devices[deviceID]; ok {
+		return quota
+	}
+	return c.DefaultDeviceBytes
+}
+
+// checkQuota returns a *quotaExceededError if storing size more bytes for the device would exceed its quota. The
+// resumable upload with the given ID, if any, is the one being stored and is not counted as in progress.
+func (s *uploadStore) checkQuota(deviceID string, size int64, id string) error {
+	quota := s.quotas.quota(deviceID)
+	if quota <= 0 {
+		return nil
+	}
+	_, usage := s.catalog.usage(deviceID)
+	uploads, err := s.inProgress()
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if upload.Metadata.DeviceID == deviceID && upload.ID != id {
+			usage += upload.Length
+		}
+	}
+	if usage+size > quota {
+		return &quotaExceededError{deviceID: deviceID, quota: quota, usage: usage, size: size}
+	}
+	return nil
+}
+
+// writeQuotaExceeded responds 507 with the usage and quota of the device
+func writeQuotaExceeded(w http.ResponseWriter, err *quotaExceededError) {
+	writeJSON(w, http.StatusInsufficientStorage, media_processing_workflow.APIError{
+		Message: "The upload exceeds the storage quota of the device.",
+		Code:    media_processing_workflow.APIErrorCodeQuotaExceeded,
+		Details: []string{err.Error()},
+	})
+}
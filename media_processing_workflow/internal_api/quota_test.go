@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createUpload(t *testing.T, serverURL string, length int, deviceID string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/uploads", nil)
+	require.NoError(t, err)
+	req.Header.Set(media_processing_workflow.UploadLengthHeader, strconv.Itoa(length))
+	req.Header.Set(media_processing_workflow.DeviceIDHeader, deviceID)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func patchUpload(t *testing.T, serverURL string, location string, offset int, chunk string) *http.Response {
+	req, err := http.NewRequest(http.MethodPatch, serverURL+location, strings.NewReader(chunk))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", media_processing_workflow.OffsetOctetStreamContentType)
+	req.Header.Set(media_processing_workflow.UploadOffsetHeader, strconv.Itoa(offset))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func Test_Quota_Multipart(t *testing.T) {
+	server, _ := newTestServer(t, StorageConfig{Quotas: QuotaConfig{
+		DefaultDeviceBytes: 100,
+		Devices:            map[string]int64{"device-2": 0},
+	}}, false)
+	device := func(id string) map[string]string {
+		return map[string]string{media_processing_workflow.DeviceIDHeader: id}
+	}
+
+	resp := postMultipart(t, server.URL, strings.Repeat("a", 60), device("device-1"))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = postMultipart(t, server.URL, strings.Repeat("b", 60), device("device-1"))
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	var apiErr media_processing_workflow.APIError
+	decodeResponse(t, resp, &apiErr)
+	assert.Equal(t, media_processing_workflow.APIErrorCodeQuotaExceeded, apiErr.Code)
+	assert.Equal(t, []string{"device device-1 stores 60 bytes; 60 more would exceed its quota of 100 bytes"}, apiErr.Details)
+
+	// unlimited devices and uploads without a device are not subject to quotas
+	for _, headers := range []map[string]string{device("device-2"), nil} {
+		resp = postMultipart(t, server.URL, strings.Repeat("c", 200), headers)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+}
+
+func Test_Quota_ResumableReservation(t *testing.T) {
+	server, _ := newTestServer(t, StorageConfig{Quotas: QuotaConfig{DefaultDeviceBytes: 100}}, false)
+
+	first := createUpload(t, server.URL, 60, "device-1")
+	first.Body.Close()
+	require.Equal(t, http.StatusCreated, first.StatusCode)
+
+	// the Upload-Length of the upload in progress is reserved
+	resp := createUpload(t, server.URL, 60, "device-1")
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	var apiErr media_processing_workflow.APIError
+	decodeResponse(t, resp, &apiErr)
+	assert.Equal(t, []string{"device device-1 stores 60 bytes; 60 more would exceed its quota of 100 bytes"}, apiErr.Details)
+	resp = postMultipart(t, server.URL, strings.Repeat("b", 60), map[string]string{media_processing_workflow.DeviceIDHeader: "device-1"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+	// the upload does not count against its own reservation once it completes
+	resp = patchUpload(t, server.URL, first.Header.Get("Location"), 0, strings.Repeat("a", 60))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = createUpload(t, server.URL, 40, "device-1")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/pborman/uuid"
+)
+
+// resumableUpload is the state of an upload created through POST /uploads. It is persisted next to the
+// partially written data so that uploads survive a restart of the internal API.
+type resumableUpload struct {
+	ID        string    `json:"id"`
+	Length    int64     `json:"length"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Metadata is declared when the upload is created and recorded in the catalog once it is complete
+	Metadata uploadMetadata `json:"metadata"`
+	// StoredFile is set once every byte has been received and the data moved into the upload directory
+	StoredFile string `json:"storedFile,omitempty"`
+}
+
+// resumableStore keeps the resumable uploads in the `.resumable` directory of the upload directory
+// until they are complete and committed to the upload store. Uploads untouched for longer than expiry
+// are removed by the janitor, whether they were abandoned or completed.
+type resumableStore struct {
+	uploads *uploadStore
+	dir     string
+	expiry  time.Duration
+}
+
+// resumableDirName is the directory of the resumable uploads within the upload directory
+const resumableDirName = ".resumable"
+
+func newResumableStore(uploads *uploadStore, expiry time.Duration) (*resumableStore, error) {
+	dir := filepath.Join(uploads.dir, resumableDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &resumableStore{uploads: uploads, dir: dir, expiry: expiry}, nil
+}
+
+func (s *resumableStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *resumableStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".part")
+}
+
+// inProgress returns the resumable uploads that are not complete yet; they count against the quota of their device
+// and the max_total_size of the retention policy with their whole Upload-Length
+func (s *uploadStore) inProgress() ([]resumableUpload, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, resumableDirName, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	uploads := []resumableUpload{}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// completed or expired since the directory was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var upload resumableUpload
+		if err := json.Unmarshal(b, &upload); err != nil {
+			return nil, fmt.Errorf("reading resumable upload %s: %v", path, err)
+		}
+		if upload.StoredFile == "" {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+func (s *resumableStore) load(id string) (*resumableUpload, error) {
+	// ids are generated by the server; anything else cannot name an upload
+	if uuid.Parse(id) == nil {
+		return nil, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var upload resumableUpload
+	if err := json.Unmarshal(b, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (s *resumableStore) save(upload *resumableUpload) error {
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(upload.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(upload.ID))
+}
+
+// offset returns the number of bytes stored for the upload
+func (s *resumableStore) offset(upload *resumableUpload) (int64, error) {
+	if upload.StoredFile != "" {
+		return upload.Length, nil
+	}
+	info, err := os.Stat(s.dataPath(upload.ID))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// complete commits the received data to the upload store. Every byte has been received by then, so a client
+// disconnecting does not interrupt the validation; an upload that fails to be stored stays at its Upload-Length,
+// and an empty chunk at that offset completes it again.
+func (s *resumableStore) complete(upload *resumableUpload) (media_processing_workflow.UploadRecord, error) {
+	record, err := s.uploads.commit(context.Background(), upload.ID, s.dataPath(upload.ID), upload.Metadata)
+	if err != nil {
+		return record, err
+	}
+	upload.StoredFile = record.FileName
+	return record, s.save(upload)
+}
+
+// discard removes an upload whose data was rejected, so that creating it again starts from the first byte
+func (s *resumableStore) discard(upload *resumableUpload) {
+	for _, path := range []string{s.infoPath(upload.ID), s.dataPath(upload.ID)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+	}
+}
+
+// expire removes the uploads whose files were last modified more than the expiry before now, along with files
+// left behind by an interrupted save, and returns the IDs of the removed uploads
+func (s *resumableStore) expire(now time.Time) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	// an upload is active as long as any of its files was modified recently
+	lastModified := map[string]time.Time{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		id := strings.SplitN(filepath.Base(path), ".", 2)[0]
+		if info.ModTime().After(lastModified[id]) {
+			lastModified[id] = info.ModTime()
+		}
+	}
+
+	removed := []string{}
+	for id, modified := range lastModified {
+		if now.Sub(modified) <= s.expiry {
+			continue
+		}
+		if err := s.remove(id, now); err != nil {
+			return removed, err
+		}
+		removed = append(removed, id)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// remove deletes the files of an expired upload, unless a request touched the upload since it was found expired
+func (s *resumableStore) remove(id string, now time.Time) error {
+	defer s.uploads.lock(id)()
+	paths, err := filepath.Glob(filepath.Join(s.dir, id+".*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && now.Sub(info.ModTime()) <= s.expiry {
+			return nil
+		}
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runJanitor removes the expired uploads at the interval until ctx is done
+func (s *resumableStore) runJanitor(ctx context.Context, interval time.Duration) {
+	if s.expiry <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		removed, err := s.expire(time.Now())
+		if err != nil {
+			fmt.Println("Unable to remove the expired resumable uploads:", err)
+		}
+		for _, id := range removed {
+			fmt.Printf("Removed expired resumable upload %s\n", id)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reserve creates the files of a new upload once its Upload-Length fits the quota of its device. The length is
+// counted against the quota from then on, and the quota is checked again once the upload is complete.
+func (s *resumableStore) reserve(upload *resumableUpload) error {
+	s.uploads.quotaMu.Lock()
+	defer s.uploads.quotaMu.Unlock()
+	if err := s.uploads.checkQuota(upload.Metadata.DeviceID, upload.Length, upload.ID); err != nil {
+		return err
+	}
+	data, err := os.Create(s.dataPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	data.Close()
+	if err := s.save(upload); err != nil {
+		s.discard(upload)
+		return err
+	}
+	return nil
+}
+
+// createUploadHandler handles POST /uploads. Creating an upload again with the same idempotency key returns the
+// existing upload to resume it, or the record of the stored file once the upload is complete.
+func (s *resumableStore) createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(media_processing_workflow.UploadLengthHeader), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, "A valid Upload-Length header is required.")
+		return
+	}
+	if length > s.uploads.maxUploadSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "The uploaded file is too big.")
+		return
+	}
+
+	id, err := uploadID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer s.uploads.lock(id)()
+
+	if record, err := s.uploads.record(id); err == nil {
+		fmt.Printf("Upload %s already stored as %s\n", id, record.FileName)
+		writeRecord(w, http.StatusOK, record)
+		return
+	}
+	if existing, err := s.load(id); err == nil {
+		if existing.Length != length {
+			writeError(w, http.StatusConflict, fmt.Sprintf("Upload %s was created with Upload-Length %d.", id, existing.Length))
+			return
+		}
+		w.Header().Set("Location", "/uploads/"+id)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	upload := &resumableUpload{ID: id, Length: length, CreatedAt: time.Now().UTC(), Metadata: uploadMetadataFromRequest(r)}
+	if length == 0 {
+		// nothing to resume: the empty file is committed right away, which checks the quota
+		data, err := os.Create(s.dataPath(upload.ID))
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, http.StatusInternalServerError, "Error creating the upload.")
+			return
+		}
+		data.Close()
+		record, err := s.complete(upload)
+		if writeRejection(w, err) {
+			fmt.Printf("Rejected upload %s: %v\n", upload.ID, err)
+			s.discard(upload)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, http.StatusInternalServerError, "Error creating the upload.")
+			return
+		}
+		writeRecord(w, http.StatusOK, record)
+		return
+	}
+	if err := s.reserve(upload); err != nil {
+		if writeRejection(w, err) {
+			fmt.Printf("Rejected upload %s: %v\n", id, err)
+			return
+		}
+		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, "Error creating the upload.")
+		return
+	}
+
+	fmt.Printf("Created resumable upload %s of %d bytes\n", upload.ID, length)
+	w.Header().Set("Location", "/uploads/"+upload.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// uploadOffsetHandler handles HEAD /uploads/{id}
+func (s *resumableStore) uploadOffsetHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	defer s.uploads.lock(id)()
+
+	upload, err := s.load(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Upload not found.")
+		return
+	}
+	offset, err := s.offset(upload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading the upload.")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(media_processing_workflow.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.Header().Set(media_processing_workflow.UploadLengthHeader, strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// appendChunkHandler handles PATCH /uploads/{id}. The chunk must start at the offset the server has stored;
+// whatever part of the chunk is received before a failure is kept, so the client resumes from the next HEAD.
+// A chunk running past the Upload-Length is rejected with 413 without storing any of it.
+// Chunks are answered with 204, except the last one which is answered with 200 and the record of the stored file.
+func (s *resumableStore) appendChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != media_processing_workflow.OffsetOctetStreamContentType {
+		writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+media_processing_workflow.OffsetOctetStreamContentType)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get(media_processing_workflow.UploadOffsetHeader), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "A valid Upload-Offset header is required.")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	defer s.uploads.lock(id)()
+
+	upload, err := s.load(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Upload not found.")
+		return
+	}
+	offset, err := s.offset(upload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading the upload.")
+		return
+	}
+	if clientOffset != offset {
+		w.Header().Set(media_processing_workflow.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		writeError(w, http.StatusConflict, fmt.Sprintf("Upload-Offset %d does not match the stored offset %d.", clientOffset, offset))
+		return
+	}
+
+	remaining := upload.Length - offset
+	if r.ContentLength > remaining {
+		w.Header().Set(media_processing_workflow.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		writeError(w, http.StatusRequestEntityTooLarge, "The chunk exceeds the Upload-Length.")
+		return
+	}
+
+	data, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error opening the upload.")
+		return
+	}
+	written, copyErr := io.Copy(data, io.LimitReader(r.Body, remaining))
+	// a chunk of unknown length is only found too long once remaining bytes are written; they are dropped again,
+	// so the upload stays at the offset of the rejected chunk
+	tooLong := false
+	if copyErr == nil && written == remaining {
+		if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+			tooLong = true
+			copyErr = data.Truncate(offset)
+			written = 0
+		}
+	}
+	syncErr := data.Sync()
+	data.Close()
+
+	if copyErr != nil || syncErr != nil {
+		// the size on disk is what the client resumes from
+		if stored, err := s.offset(upload); err == nil {
+			offset = stored
+		} else {
+			offset += written
+		}
+		fmt.Printf("Upload %s interrupted at offset %d: %v %v\n", id, offset, copyErr, syncErr)
+		w.Header().Set(media_processing_workflow.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		writeError(w, http.StatusInternalServerError, "Error writing the chunk.")
+		return
+	}
+	if tooLong {
+		w.Header().Set(media_processing_workflow.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		writeError(w, http.StatusRequestEntityTooLarge, "The chunk exceeds the Upload-Length.")
+		return
+	}
+	offset += written
+
+	w.Header().Set(media_processing_workflow.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	if offset == upload.Length {
+		record, err := s.complete(upload)
+		if writeRejection(w, err) {
+			fmt.Printf("Rejected upload %s: %v\n", id, err)
+			s.discard(upload)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, http.StatusInternalServerError, "Error storing the upload.")
+			return
+		}
+		fmt.Printf("Completed resumable upload %s as %s\n", id, upload.StoredFile)
+		// the last chunk is answered with the record of the stored file
+		writeRecord(w, http.StatusOK, record)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
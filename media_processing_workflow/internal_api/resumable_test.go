@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStore returns an upload store without validation in a temporary directory
+func newTestStore(t *testing.T, storage StorageConfig) *uploadStore {
+	dir, err := ioutil.TempDir("", "internalapi")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	storage.Dir = dir
+	if storage.MaxUploadSize == 0 {
+		storage.MaxUploadSize = defaultMaxUploadSize
+	}
+	events := newEventBus(EventsConfig{})
+	t.Cleanup(events.closeStreams)
+	uploads, err := newUploadStore(storage, ValidationConfig{}, events)
+	require.NoError(t, err)
+	return uploads
+}
+
+func createResumableUpload(t *testing.T, s *resumableStore, length int) string {
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set(media_processing_workflow.UploadLengthHeader, strconv.Itoa(length))
+	resp := httptest.NewRecorder()
+	s.createUploadHandler(resp, req)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	return strings.TrimPrefix(resp.Header().Get("Location"), "/uploads/")
+}
+
+func appendChunk(s *resumableStore, id string, offset int, chunk string, contentLength int64) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, "/uploads/"+id, strings.NewReader(chunk))
+	req.Header.Set("Content-Type", media_processing_workflow.OffsetOctetStreamContentType)
+	req.Header.Set(media_processing_workflow.UploadOffsetHeader, strconv.Itoa(offset))
+	req.ContentLength = contentLength
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	resp := httptest.NewRecorder()
+	s.appendChunkHandler(resp, req)
+	return resp
+}
+
+func Test_AppendChunk_TooLong(t *testing.T) {
+	uploads := newTestStore(t, StorageConfig{})
+	s, err := newResumableStore(uploads, time.Hour)
+	require.NoError(t, err)
+	id := createResumableUpload(t, s, 10)
+
+	resp := appendChunk(s, id, 0, "0123", 4)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	// rejected from its Content-Length before any byte is stored
+	resp = appendChunk(s, id, 4, "456789AB", 8)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Equal(t, "4", resp.Header().Get(media_processing_workflow.UploadOffsetHeader))
+
+	// a chunk of unknown length is dropped once it runs past the Upload-Length
+	resp = appendChunk(s, id, 4, "456789AB", -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Equal(t, "4", resp.Header().Get(media_processing_workflow.UploadOffsetHeader))
+
+	resp = appendChunk(s, id, 4, "456789", 6)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	record, err := uploads.record(id)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadFile(uploads.path(record))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(contents))
+
+	assert.Empty(t, uploads.locks)
+}
+
+func Test_AppendChunk_CompletesAfterFailedStore(t *testing.T) {
+	uploads := newTestStore(t, StorageConfig{})
+	s, err := newResumableStore(uploads, time.Hour)
+	require.NoError(t, err)
+	id := createResumableUpload(t, s, 10)
+
+	// a non-empty directory in place of the stored file makes moving the data into place fail
+	blocking := filepath.Join(uploads.dir, storedFileName(id))
+	require.NoError(t, os.MkdirAll(filepath.Join(blocking, "file"), 0755))
+	resp := appendChunk(s, id, 0, "0123456789", 10)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	_, err = uploads.record(id)
+	assert.Error(t, err)
+
+	// the upload keeps every received byte, and an empty chunk at its end stores it
+	require.NoError(t, os.RemoveAll(blocking))
+	resp = appendChunk(s, id, 10, "", 0)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	record, err := uploads.record(id)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadFile(uploads.path(record))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(contents))
+	inProgress, err := uploads.inProgress()
+	require.NoError(t, err)
+	assert.Empty(t, inProgress)
+}
+
+func Test_ResumableExpiry(t *testing.T) {
+	uploads := newTestStore(t, StorageConfig{})
+	s, err := newResumableStore(uploads, time.Hour)
+	require.NoError(t, err)
+	abandoned := createResumableUpload(t, s, 10)
+	active := createResumableUpload(t, s, 10)
+	assert.Equal(t, http.StatusNoContent, appendChunk(s, abandoned, 0, "0123", 4).Code)
+	// left behind by a save interrupted by a crash
+	require.NoError(t, ioutil.WriteFile(s.infoPath(abandoned)+".tmp", nil, 0644))
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{s.infoPath(abandoned), s.dataPath(abandoned), s.infoPath(abandoned) + ".tmp", s.infoPath(active)} {
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+
+	removed, err := s.expire(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []string{abandoned}, removed)
+	files, err := ioutil.ReadDir(s.dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		assert.True(t, strings.HasPrefix(f.Name(), active))
+	}
+
+	resp := appendChunk(s, abandoned, 4, "456789", 6)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
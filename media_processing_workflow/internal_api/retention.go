@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// retentionReport describes the storage used per device and the uploads the retention policy deletes
+type retentionReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	TotalBytes  int64     `json:"totalBytes"`
+	// InProgressBytes is the Upload-Length of the resumable uploads in progress, which is not part of TotalBytes
+	InProgressBytes int64             `json:"inProgressBytes"`
+	Devices         []deviceUsage     `json:"devices"`
+	Expired         []expiredUpload   `json:"expired"`
+	Retention       retentionSettings `json:"retention"`
+}
+
+// deviceUsage is the storage used by the uploads of a device; uploads without a device ID are reported under ""
+type deviceUsage struct {
+	DeviceID string `json:"deviceId"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	// InProgressFiles and InProgressBytes are the resumable uploads of the device in progress and their Upload-Length
+	InProgressFiles int   `json:"inProgressFiles"`
+	InProgressBytes int64 `json:"inProgressBytes"`
+	// QuotaBytes is the quota of the device; zero is unlimited
+	QuotaBytes int64 `json:"quotaBytes"`
+}
+
+type expiredUpload struct {
+	Record media_processing_workflow.UploadRecord `json:"record"`
+	Reason string                                 `json:"reason"`
+}
+
+type retentionSettings struct {
+	MaxAgeSeconds float64 `json:"maxAgeSeconds"`
+	MaxTotalSize  int64   `json:"maxTotalSize"`
+}
+
+// retentionReport evaluates the retention policy at the given time without deleting anything. The resumable
+// uploads in progress are not deleted, but count against max_total_size: the stored uploads make room for them.
+func (s *uploadStore) retentionReport(now time.Time) (retentionReport, error) {
+	report := retentionReport{
+		GeneratedAt: now.UTC(),
+		Devices:     []deviceUsage{},
+		Expired:     []expiredUpload{},
+		Retention: retentionSettings{
+			MaxAgeSeconds: s.retention.MaxAge.Seconds(),
+			MaxTotalSize:  s.retention.MaxTotalSize,
+		},
+	}
+
+	usage := map[string]*deviceUsage{}
+	deviceUsageOf := func(deviceID string) *deviceUsage {
+		u, ok := usage[deviceID]
+		if !ok {
+			u = &deviceUsage{DeviceID: deviceID, QuotaBytes: s.quotas.quota(deviceID)}
+			usage[deviceID] = u
+		}
+		return u
+	}
+
+	inProgress, err := s.inProgress()
+	if err != nil {
+		return report, err
+	}
+	for _, upload := range inProgress {
+		report.InProgressBytes += upload.Length
+		u := deviceUsageOf(upload.Metadata.DeviceID)
+		u.InProgressFiles++
+		u.InProgressBytes += upload.Length
+	}
+
+	kept := report.InProgressBytes
+	// most recent first: the oldest uploads are the first to go once the total size is exceeded
+	for _, record := range s.catalog.list("", "") {
+		report.TotalBytes += record.Size
+		u := deviceUsageOf(record.DeviceID)
+		u.Files++
+		u.Bytes += record.Size
+
+		switch {
+		case s.retention.MaxAge > 0 && now.Sub(record.UploadedAt) > s.retention.MaxAge:
+			report.Expired = append(report.Expired, expiredUpload{Record: record, Reason: fmt.Sprintf("older than %s", s.retention.MaxAge)})
+		case s.retention.MaxTotalSize > 0 && kept+record.Size > s.retention.MaxTotalSize:
+			report.Expired = append(report.Expired, expiredUpload{Record: record, Reason: fmt.Sprintf("the newer and in-progress uploads fill the %d bytes of max_total_size", s.retention.MaxTotalSize)})
+		default:
+			kept += record.Size
+		}
+	}
+	for _, u := range usage {
+		report.Devices = append(report.Devices, *u)
+	}
+	sort.Slice(report.Devices, func(i, j int) bool { return report.Devices[i].DeviceID < report.Devices[j].DeviceID })
+	return report, nil
+}
+
+// enforceRetention deletes the uploads expired by the retention policy and returns their records
+func (s *uploadStore) enforceRetention(now time.Time) ([]media_processing_workflow.UploadRecord, error) {
+	removed := []media_processing_workflow.UploadRecord{}
+	report, err := s.retentionReport(now)
+	if err != nil {
+		return removed, err
+	}
+	for _, expired := range report.Expired {
+		if err := s.remove(expired.Record.ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, expired.Record)
+	}
+	return removed, nil
+}
+
+// remove deletes a stored upload. The record goes first, so that a file left behind by a failed removal is
+// recorded again by the reconciliation on the next start and removed by a later run of the janitor.
+func (s *uploadStore) remove(id string) error {
+	defer s.lock(id)()
+	record, err := s.record(id)
+	if err != nil {
+		return nil
+	}
+	if err := s.catalog.remove(id); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(record)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// runJanitor enforces the retention policy at the janitor interval until ctx is done
+func (s *uploadStore) runJanitor(ctx context.Context) {
+	if s.retention.MaxAge <= 0 && s.retention.MaxTotalSize <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.retention.JanitorInterval)
+	defer ticker.Stop()
+	for {
+		removed, err := s.enforceRetention(time.Now())
+		if err != nil {
+			fmt.Println("Unable to enforce the retention policy:", err)
+		}
+		for _, record := range removed {
+			fmt.Printf("Removed expired upload %s (%d bytes, uploaded %s)\n", record.FileName, record.Size, record.UploadedAt.Format(time.RFC3339))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retentionReportHandler handles GET /retention/report, a dry run of the janitor along with the storage used
+// per device
+func (s *uploadStore) retentionReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := s.retentionReport(time.Now())
+	if err != nil {
+		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, "Error evaluating the retention policy.")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
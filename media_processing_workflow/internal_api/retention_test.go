@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storeTestUpload stores a file of the given size as an upload of the device made at uploadedAt
+func storeTestUpload(t *testing.T, s *uploadStore, id string, deviceID string, size int, uploadedAt time.Time) media_processing_workflow.UploadRecord {
+	record := media_processing_workflow.UploadRecord{ID: id, FileName: storedFileName(id), DeviceID: deviceID, Size: int64(size), UploadedAt: uploadedAt}
+	require.NoError(t, ioutil.WriteFile(s.path(record), make([]byte, size), 0644))
+	require.NoError(t, s.catalog.put(record))
+	return record
+}
+
+func Test_RetentionReport(t *testing.T) {
+	server, uploads := newTestServer(t, StorageConfig{
+		Quotas:    QuotaConfig{Devices: map[string]int64{"device-1": 1000}},
+		Retention: RetentionConfig{MaxAge: 24 * time.Hour, MaxTotalSize: 100},
+	}, false)
+	now := time.Now()
+	old := storeTestUpload(t, uploads, "old", "device-1", 10, now.Add(-48*time.Hour))
+	oldest := storeTestUpload(t, uploads, "oldest-recent", "device-2", 30, now.Add(-3*time.Hour))
+	older := storeTestUpload(t, uploads, "older", "device-1", 30, now.Add(-2*time.Hour))
+	recent := storeTestUpload(t, uploads, "recent", "device-2", 30, now.Add(-time.Hour))
+	// the 20 bytes in progress and the 60 of the two recent uploads leave no room for the third one
+	resp := createUpload(t, server.URL, 20, "device-1")
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err := http.Get(server.URL + "/retention/report")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var report retentionReport
+	decodeResponse(t, resp, &report)
+
+	assert.Equal(t, int64(100), report.TotalBytes)
+	assert.Equal(t, int64(20), report.InProgressBytes)
+	assert.Equal(t, []deviceUsage{
+		{DeviceID: "device-1", Files: 2, Bytes: 40, InProgressFiles: 1, InProgressBytes: 20, QuotaBytes: 1000},
+		{DeviceID: "device-2", Files: 2, Bytes: 60},
+	}, report.Devices)
+	require.Len(t, report.Expired, 2)
+	assert.Equal(t, oldest.ID, report.Expired[0].Record.ID)
+	assert.Equal(t, "the newer and in-progress uploads fill the 100 bytes of max_total_size", report.Expired[0].Reason)
+	assert.Equal(t, old.ID, report.Expired[1].Record.ID)
+	assert.Equal(t, "older than 24h0m0s", report.Expired[1].Reason)
+
+	removed, err := uploads.enforceRetention(now)
+	require.NoError(t, err)
+	assert.Len(t, removed, 2)
+	assert.NoFileExists(t, uploads.path(old))
+	assert.NoFileExists(t, uploads.path(oldest))
+	assert.FileExists(t, uploads.path(older))
+	assert.FileExists(t, uploads.path(recent))
+	assert.Equal(t, []media_processing_workflow.UploadRecord{recent, older}, uploads.catalog.list("", ""))
+}
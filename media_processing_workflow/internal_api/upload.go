@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/pborman/uuid"
+)
+
+// idempotencyNamespace derives upload IDs from idempotency keys, so that a key always maps to the same stored file
+var idempotencyNamespace = uuid.Parse("3d1b6a8e-58a4-4a53-9f0c-2b1f4f7e6c21")
+
+const maxIdempotencyKeyLength = 255
+
+// maxMultipartOverhead bounds the bytes of a multipart upload besides the file: boundaries, part headers and fields
+const maxMultipartOverhead = 64 * 1024
+
+// uploadStore keeps the uploaded media files in a single directory. Files are written under a temporary name
+// and renamed once complete, so a file with the final name is always a complete upload; every stored file is
+// recorded in the catalog. Uploads that fail validation or exceed the quota of their device are never stored.
+type uploadStore struct {
+	dir           string
+	maxUploadSize int64
+	catalog       *catalog
+	validation    ValidationConfig
+	quotas        QuotaConfig
+	retention     RetentionConfig
+	events        *eventBus
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+	// quotaMu serializes the quota check and the storing of an upload, so that concurrent uploads of a device
+	// cannot exceed its quota together
+	quotaMu sync.Mutex
+}
+
+// uploadMetadata describes an upload as declared by the client
+type uploadMetadata struct {
+	DeviceID   string `json:"deviceId,omitempty"`
+	WorkflowID string `json:"workflowId,omitempty"`
+}
+
+func uploadMetadataFromRequest(r *http.Request) uploadMetadata {
+	return uploadMetadata{
+		DeviceID:   r.Header.Get(media_processing_workflow.DeviceIDHeader),
+		WorkflowID: r.Header.Get(media_processing_workflow.WorkflowIDHeader),
+	}
+}
+
+func newUploadStore(storage StorageConfig, validation ValidationConfig, events *eventBus) (*uploadStore, error) {
+	dir, err := filepath.Abs(storage.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c, err := openCatalog(filepath.Join(dir, ".catalog.json"))
+	if err != nil {
+		return nil, err
+	}
+	s := &uploadStore{
+		dir:           dir,
+		maxUploadSize: storage.MaxUploadSize,
+		catalog:       c,
+		validation:    validation,
+		quotas:        storage.Quotas,
+		retention:     storage.Retention,
+		events:        events,
+		locks:         map[string]*uploadLock{},
+	}
+	return s, s.reconcile()
+}
+
+// reconcile adds the stored files missing from the catalog, such as files stored before the catalog existed
+// or by a process that stopped between storing a file and recording it
+func (s *uploadStore) reconcile() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, storedFileName("*")))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "video-"), ".mp4")
+		if _, ok := s.catalog.get(id); ok {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		var probe *media_processing_workflow.MediaProbe
+		if p, err := media_processing_workflow.ProbeMedia(context.Background(), path); err == nil {
+			probe = &p
+		} else {
+			fmt.Println(err)
+		}
+		record, err := s.describe(id, path, uploadMetadata{}, probe)
+		if err != nil {
+			return err
+		}
+		record.UploadedAt = info.ModTime().UTC()
+		if err := s.catalog.put(record); err != nil {
+			return err
+		}
+		fmt.Printf("Recorded %s in the catalog\n", record.FileName)
+	}
+	return nil
+}
+
+// uploadLock serializes the requests for an upload ID; refs counts the requests holding or waiting for it
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock serializes the requests for a single upload ID. The lock is forgotten once no request holds or waits for
+// it, so the map only grows with the uploads in progress.
+func (s *uploadStore) lock(id string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &uploadLock{}
+		s.locks[id] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// uploadID returns the ID for a new upload: derived from the idempotency key when there is one, random otherwise
+func uploadID(r *http.Request) (string, error) {
+	key := r.Header.Get(media_processing_workflow.IdempotencyKeyHeader)
+	if key == "" {
+		return uuid.New(), nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("the %s header exceeds %d characters", media_processing_workflow.IdempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+	return uuid.NewSHA1(idempotencyNamespace, []byte(key)).String(), nil
+}
+
+func storedFileName(id string) string {
+	return fmt.Sprintf("video-%s.mp4", id)
+}
+
+// record returns the record of a stored upload, or os.ErrNotExist if there is none
+func (s *uploadStore) record(id string) (media_processing_workflow.UploadRecord, error) {
+	record, ok := s.catalog.get(id)
+	if !ok {
+		return record, os.ErrNotExist
+	}
+	return record, nil
+}
+
+// path returns the location of the stored file of the record
+func (s *uploadStore) path(record media_processing_workflow.UploadRecord) string {
+	return filepath.Join(s.dir, filepath.Base(record.FileName))
+}
+
+// describe hashes the file to build the record of the upload with the given ID. The duration is taken from the
+// probe, and left at zero when there is none.
+func (s *uploadStore) describe(id string, path string, metadata uploadMetadata, probe *media_processing_workflow.MediaProbe) (media_processing_workflow.UploadRecord, error) {
+	record := media_processing_workflow.UploadRecord{
+		ID:         id,
+		FileName:   storedFileName(id),
+		Location:   "/media/" + id + "/content",
+		DeviceID:   metadata.DeviceID,
+		WorkflowID: metadata.WorkflowID,
+		UploadedAt: time.Now().UTC(),
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return record, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if record.Size, err = io.Copy(hash, f); err != nil {
+		return record, err
+	}
+	record.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	if probe != nil {
+		record.Duration = probe.Duration()
+	}
+	return record, nil
+}
+
+// commit validates a completely written file, then moves it into place as the upload with the given ID, records
+// it in the catalog and emits its event. A rejected file is left in place and reported with an *invalidMediaError
+// or *quotaExceededError.
+func (s *uploadStore) commit(ctx context.Context, id string, tmpPath string, metadata uploadMetadata) (media_processing_workflow.UploadRecord, error) {
+	probe, err := s.validation.validate(ctx, tmpPath)
+	if err != nil {
+		return media_processing_workflow.UploadRecord{}, err
+	}
+	record, err := s.describe(id, tmpPath, metadata, probe)
+	if err != nil {
+		return record, err
+	}
+
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if err := s.checkQuota(metadata.DeviceID, record.Size, id); err != nil {
+		return record, err
+	}
+	if err := os.Rename(tmpPath, s.path(record)); err != nil {
+		return record, err
+	}
+	if err := s.catalog.put(record); err != nil {
+		return record, err
+	}
+	s.events.publish(record)
+	return record, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeRecord(w http.ResponseWriter, status int, record media_processing_workflow.UploadRecord) {
+	writeJSON(w, status, record)
+}
+
+// writeError responds with an APIError, so that clients can report why the request failed
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, media_processing_workflow.APIError{Message: message})
+}
+
+// writeRejection responds to the errors rejecting an upload and reports whether err was one of them
+func writeRejection(w http.ResponseWriter, err error) bool {
+	switch e := err.(type) {
+	case *invalidMediaError:
+		writeInvalidMedia(w, e)
+	case *quotaExceededError:
+		writeQuotaExceeded(w, e)
+	default:
+		return false
+	}
+	return true
+}
+
+// nextFilePart returns the file part of a multipart upload, skipping the form fields before it
+func nextFilePart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			// io.EOF: the form ended without a file part
+			return nil, err
+		}
+		if part.FormName() == media_processing_workflow.FileNameAttribute && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// countingReader counts the bytes read from a request body. Under an http.MaxBytesReader, which reads one byte past
+// its limit to find an oversized body, the count tells a body cut off at the limit apart from other read errors.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// fileWriter records the error of a failed write, so that a full disk is told apart from an interrupted request
+type fileWriter struct {
+	file *os.File
+	err  error
+}
+
+func (f *fileWriter) Write(b []byte) (int, error) {
+	n, err := f.file.Write(b)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// uploadMediaHandler streams the file of a multipart upload to disk. A repeated upload with the same idempotency key
+// is not stored again; the record of the original upload is returned instead.
+func (s *uploadStore) uploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "Only POST Method is permitted")
+		return
+	}
+
+	id, err := uploadID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer s.lock(id)()
+
+	if record, err := s.record(id); err == nil {
+		fmt.Printf("Upload %s already stored as %s\n", id, record.FileName)
+		writeRecord(w, http.StatusOK, record)
+		return
+	}
+
+	if r.ContentLength > s.maxUploadSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "The uploaded file is too big.")
+		return
+	}
+	// uploads that cannot fit the quota are rejected before they are transferred; the size of the file is checked
+	// once it is stored
+	metadata := uploadMetadataFromRequest(r)
+	if minSize := r.ContentLength - maxMultipartOverhead; minSize > 0 && writeRejection(w, s.checkQuota(metadata.DeviceID, minSize, id)) {
+		fmt.Printf("Rejected upload %s of %d bytes: over quota\n", id, r.ContentLength)
+		return
+	}
+	// the body is streamed part by part, so the limit applies to the whole request whatever its Content-Length
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = http.MaxBytesReader(w, body, s.maxUploadSize)
+
+	part, err := nextFilePart(r)
+	if err != nil {
+		fmt.Println(err)
+		if body.n > s.maxUploadSize {
+			writeError(w, http.StatusRequestEntityTooLarge, "The uploaded file is too big.")
+		} else {
+			writeError(w, http.StatusBadRequest, "The request has no "+media_processing_workflow.FileNameAttribute+" file part.")
+		}
+		return
+	}
+	defer part.Close()
+	fmt.Printf("Uploaded File Name: %+v\n", part.FileName())
+	fmt.Printf("MIME Header: %+v\n", part.Header)
+
+	// The uploaded file is written under a temporary name within the upload directory and renamed once complete
+	tmpFile, err := ioutil.TempFile(s.dir, ".upload-*")
+	if err != nil {
+		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, "Error storing the uploaded file.")
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	dst := &fileWriter{file: tmpFile}
+	size, err := io.Copy(dst, part)
+	if err != nil {
+		fmt.Printf("Upload %s failed after %d bytes: %v\n", id, size, err)
+		switch {
+		case dst.err != nil:
+			writeError(w, http.StatusInternalServerError, "Error writing the contents of the uploaded file.")
+		case body.n > s.maxUploadSize:
+			writeError(w, http.StatusRequestEntityTooLarge, "The uploaded file is too big.")
+		default:
+			writeError(w, http.StatusBadRequest, "Error reading the contents of the uploaded file.")
+		}
+		return
+	}
+	// temporary files are private to the process; the stored file is not
+	if err := tmpFile.Chmod(0644); err != nil {
+		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, "Error writing the contents of the uploaded file.")
+		return
+	}
+	if err := tmpFile.Sync(); err != nil {
+		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, "Error writing the contents of the uploaded file.")
+		return
+	}
+	if err := tmpFile.Close(); err != nil {
+		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, "Error writing the contents of the uploaded file.")
+		return
+	}
+	fmt.Printf("File Size bytes: %+v\n", size)
+
+	record, err := s.commit(r.Context(), id, tmpFile.Name(), metadata)
+	if writeRejection(w, err) {
+		fmt.Printf("Rejected upload %s: %v\n", id, err)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		writeError(w, http.StatusInternalServerError, "Error storing the uploaded file.")
+		return
+	}
+	fmt.Printf("Stored upload %s as %s\n", id, record.FileName)
+	writeRecord(w, http.StatusCreated, record)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postMultipart uploads the contents to /uploadmedia as the file part, with the headers set on the request
+func postMultipart(t *testing.T, serverURL string, contents string, headers map[string]string) *http.Response {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("note", "fields before the file are skipped"))
+	part, err := writer.CreateFormFile(media_processing_workflow.FileNameAttribute, "merged.mp4")
+	require.NoError(t, err)
+	_, err = part.Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/uploadmedia", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func decodeResponse(t *testing.T, resp *http.Response, v interface{}) {
+	defer resp.Body.Close()
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+}
+
+func Test_UploadMediaHandler(t *testing.T) {
+	server, uploads := newTestServer(t, StorageConfig{}, false)
+	headers := map[string]string{
+		media_processing_workflow.IdempotencyKeyHeader: "workflow-1/run-1/merged.mp4",
+		media_processing_workflow.DeviceIDHeader:       "device-1",
+		media_processing_workflow.WorkflowIDHeader:     "workflow-1",
+	}
+
+	resp := postMultipart(t, server.URL, "merged media", headers)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var record media_processing_workflow.UploadRecord
+	decodeResponse(t, resp, &record)
+	assert.Equal(t, int64(len("merged media")), record.Size)
+	assert.Equal(t, "device-1", record.DeviceID)
+	assert.Equal(t, "workflow-1", record.WorkflowID)
+	assert.Equal(t, "/media/"+record.ID+"/content", record.Location)
+	contents, err := ioutil.ReadFile(uploads.path(record))
+	require.NoError(t, err)
+	assert.Equal(t, "merged media", string(contents))
+
+	// a retry with the same idempotency key is answered with the stored record
+	resp = postMultipart(t, server.URL, "merged media", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var retried media_processing_workflow.UploadRecord
+	decodeResponse(t, resp, &retried)
+	assert.Equal(t, record, retried)
+
+	resp, err = http.Get(server.URL + record.Location)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	contents, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "merged media", string(contents))
+}
+
+func Test_UploadMediaHandler_Rejected(t *testing.T) {
+	server, uploads := newTestServer(t, StorageConfig{MaxUploadSize: 1024}, false)
+
+	resp := postMultipart(t, server.URL, strings.Repeat("x", 2048), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	var apiErr media_processing_workflow.APIError
+	decodeResponse(t, resp, &apiErr)
+	assert.Equal(t, "The uploaded file is too big.", apiErr.Message)
+
+	// bodies of unknown length are cut off at the limit, whether in the file part or in the fields before it
+	for _, form := range []string{
+		"--x\r\nContent-Disposition: form-data; name=\"file\"; filename=\"merged.mp4\"\r\n\r\n" + strings.Repeat("x", 2048) + "\r\n--x--\r\n",
+		"--x\r\nContent-Disposition: form-data; name=\"note\"\r\n\r\n" + strings.Repeat("x", 2048) + "\r\n--x--\r\n",
+	} {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/uploadmedia", ioutil.NopCloser(strings.NewReader(form)))
+		require.NoError(t, err)
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+
+	resp, err := http.Post(server.URL+"/uploadmedia", "multipart/form-data; boundary=x", strings.NewReader("--x--\r\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/uploadmedia")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// nothing is left behind by the rejected uploads
+	files, err := filepath.Glob(filepath.Join(uploads.dir, "*"))
+	require.NoError(t, err)
+	for _, file := range files {
+		assert.Contains(t, []string{".catalog.json", ".catalog.journal", resumableDirName}, filepath.Base(file))
+	}
+	assert.Empty(t, uploads.catalog.list("", ""))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// invalidMediaError rejects an upload that is not a decodable media file or breaks the validation rules
+type invalidMediaError struct {
+	problems []string
+}
+
+func (e *invalidMediaError) Error() string {
+	return "invalid media: " + strings.Join(e.problems, "; ")
+}
+
+// validate probes the file and checks it against the validation rules. The probe is returned for the record of
+// the upload; it is nil when validation is disabled.
+func (c ValidationConfig) validate(ctx context.Context, path string) (*media_processing_workflow.MediaProbe, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	probe, err := media_processing_workflow.ProbeMedia(ctx, path)
+	if err != nil {
+		// a missing ffprobe is a problem of the server, not of the upload
+		if errors.Is(err, exec.ErrNotFound) || ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, &invalidMediaError{problems: []string{"the file is not a decodable media file"}}
+	}
+	if problems := c.check(probe); len(problems) > 0 {
+		return nil, &invalidMediaError{problems: problems}
+	}
+	return &probe, nil
+}
+
+// check returns the validation rules the probed media breaks
+func (c ValidationConfig) check(probe media_processing_workflow.MediaProbe) []string {
+	problems := []string{}
+	if !allowsAny(c.AllowedContainers, strings.Split(probe.Format.FormatName, ",")) {
+		problems = append(problems, fmt.Sprintf("container %q is not allowed", probe.Format.FormatName))
+	}
+	if c.RequireVideo && probe.VideoStream() == nil {
+		problems = append(problems, "the file has no video stream")
+	}
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			if !allowsAny(c.AllowedVideoCodecs, []string{stream.CodecName}) {
+				problems = append(problems, fmt.Sprintf("video codec %q is not allowed", stream.CodecName))
+			}
+		case "audio":
+			if !allowsAny(c.AllowedAudioCodecs, []string{stream.CodecName}) {
+				problems = append(problems, fmt.Sprintf("audio codec %q is not allowed", stream.CodecName))
+			}
+		}
+	}
+	if c.MaxDurationSeconds > 0 && probe.Duration() > c.MaxDurationSeconds {
+		problems = append(problems, fmt.Sprintf("duration %.1fs exceeds the maximum of %.1fs", probe.Duration(), c.MaxDurationSeconds))
+	}
+	return problems
+}
+
+// allowsAny reports whether one of the values is allowed; an empty list allows everything
+func allowsAny(allowed []string, values []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, value := range values {
+		for _, a := range allowed {
+			if strings.EqualFold(a, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeInvalidMedia responds 422 with the problems found in the upload
+func writeInvalidMedia(w http.ResponseWriter, err *invalidMediaError) {
+	writeJSON(w, http.StatusUnprocessableEntity, media_processing_workflow.APIError{
+		Message: "The uploaded file is not accepted as media.",
+		Code:    media_processing_workflow.APIErrorCodeInvalidMedia,
+		Details: err.problems,
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testValidation = ValidationConfig{
+	Enabled:            true,
+	AllowedContainers:  []string{"mp4", "mov"},
+	AllowedVideoCodecs: []string{"h264"},
+	AllowedAudioCodecs: []string{"aac"},
+	MaxDurationSeconds: 60,
+}
+
+func testProbe(duration string, streams ...media_processing_workflow.ProbeStream) media_processing_workflow.MediaProbe {
+	return media_processing_workflow.MediaProbe{
+		Streams: streams,
+		Format:  media_processing_workflow.ProbeFormat{FormatName: "mov,mp4,m4a,3gp,3g2,mj2", Duration: duration},
+	}
+}
+
+func Test_ValidationCheck(t *testing.T) {
+	video := media_processing_workflow.ProbeStream{CodecType: "video", CodecName: "h264"}
+	audio := media_processing_workflow.ProbeStream{CodecType: "audio", CodecName: "aac"}
+
+	assert.Empty(t, testValidation.check(testProbe("30.0", video, audio)))
+	// the outputs of audio-only workflows are accepted unless video is required
+	assert.Empty(t, testValidation.check(testProbe("30.0", audio)))
+	requireVideo := testValidation
+	requireVideo.RequireVideo = true
+	assert.Equal(t, []string{"the file has no video stream"}, requireVideo.check(testProbe("30.0", audio)))
+
+	vp9 := media_processing_workflow.ProbeStream{CodecType: "video", CodecName: "vp9"}
+	opus := media_processing_workflow.ProbeStream{CodecType: "audio", CodecName: "opus"}
+	assert.Equal(t, []string{`video codec "vp9" is not allowed`, `audio codec "opus" is not allowed`},
+		testValidation.check(testProbe("30.0", vp9, opus)))
+
+	assert.Equal(t, []string{"duration 61.5s exceeds the maximum of 60.0s"}, testValidation.check(testProbe("61.5", video, audio)))
+
+	webm := testProbe("30.0", video, audio)
+	webm.Format.FormatName = "matroska,webm"
+	assert.Equal(t, []string{`container "matroska,webm" is not allowed`}, testValidation.check(webm))
+
+	// empty lists allow anything
+	assert.Empty(t, ValidationConfig{Enabled: true}.check(testProbe("7200", vp9, opus)))
+}
+
+func Test_Validate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the ffprobe stub is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the stub describes files named audio as audio-only and rejects any other file
+	stub := `#!/bin/sh
+for last; do :; done
+case "$last" in
+*audio*) echo '{"streams":[{"codec_type":"audio","codec_name":"aac"}],"format":{"format_name":"mov,mp4,m4a","duration":"12.5"}}' ;;
+*) echo "Invalid data found when processing input" >&2; exit 1 ;;
+esac
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, media_processing_workflow.FFprobeCommand), []byte(stub), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	probe, err := ValidationConfig{}.validate(context.Background(), filepath.Join(dir, "notmedia"))
+	assert.NoError(t, err)
+	assert.Nil(t, probe)
+
+	probe, err = testValidation.validate(context.Background(), filepath.Join(dir, "audio.mp4"))
+	require.NoError(t, err)
+	assert.Equal(t, 12.5, probe.Duration())
+
+	requireVideo := testValidation
+	requireVideo.RequireVideo = true
+	_, err = requireVideo.validate(context.Background(), filepath.Join(dir, "audio.mp4"))
+	assert.Equal(t, &invalidMediaError{problems: []string{"the file has no video stream"}}, err)
+
+	_, err = testValidation.validate(context.Background(), filepath.Join(dir, "notmedia"))
+	assert.Equal(t, &invalidMediaError{problems: []string{"the file is not a decodable media file"}}, err)
+}
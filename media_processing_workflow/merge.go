@@ -0,0 +1,229 @@
+package media_processing_workflow
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// merge strategies recorded in MergeResult
+	MergeStrategyConcatDemuxer = "concat_demuxer"
+	MergeStrategyConcatFilter  = "concat_filter"
+
+	// normalization targets used when the clips have to be re-encoded by the concat filter
+	defaultMergeFrameRate   = 30.0
+	mergeAudioSampleRate    = 48000
+	mergeAudioChannelLayout = "stereo"
+
+	// EBU R128 loudness targets: integrated loudness, loudness range and true peak
+	loudnessTargetFilter = "loudnorm=I=-23:LRA=7:TP=-2"
+)
+
+// MergeOptions controls how MergeFilesActivity produces its output
+type MergeOptions struct {
+	// NormalizeLoudness applies EBU R128 loudness normalization to each clip so that they play at the same volume
+	NormalizeLoudness bool
+	// AudioOnly drops the video streams and produces an audio-only output
+	AudioOnly bool
+	// Range trims the merged timeline; the zero value keeps everything
+	Range ClipRange
+}
+
+// MergeResult describes the merged output and how it was produced
+type MergeResult struct {
+	FileName string
+	Strategy string
+	// Reason explains why the concat filter was chosen over the concat demuxer
+	Reason string
+	// Duration of the merged output
+	Duration time.Duration
+}
+
+// concatMismatch compares the probed clips and returns a description of the first difference that prevents
+// a stream copy through the concat demuxer. An empty string means the clips can be concatenated as-is.
+func concatMismatch(probes []MediaProbe) string {
+	if len(probes) < 2 {
+		return ""
+	}
+	first := probes[0]
+	firstVideo, firstAudio := first.VideoStream(), first.AudioStream()
+
+	for i, p := range probes[1:] {
+		clip := i + 1
+		video, audio := p.VideoStream(), p.AudioStream()
+
+		if (firstVideo == nil) != (video == nil) {
+			return fmt.Sprintf("clip %d video stream presence differs from clip 0", clip)
+		}
+		if firstVideo != nil {
+			switch {
+			case video.CodecName != firstVideo.CodecName:
+				return fmt.Sprintf("clip %d video codec %s differs from %s", clip, video.CodecName, firstVideo.CodecName)
+			case video.Width != firstVideo.Width || video.Height != firstVideo.Height:
+				return fmt.Sprintf("clip %d resolution %dx%d differs from %dx%d", clip, video.Width, video.Height, firstVideo.Width, firstVideo.Height)
+			case video.PixFmt != firstVideo.PixFmt:
+				return fmt.Sprintf("clip %d pixel format %s differs from %s", clip, video.PixFmt, firstVideo.PixFmt)
+			case video.RFrameRate != firstVideo.RFrameRate:
+				return fmt.Sprintf("clip %d frame rate %s differs from %s", clip, video.RFrameRate, firstVideo.RFrameRate)
+			case video.TimeBase != firstVideo.TimeBase:
+				return fmt.Sprintf("clip %d timebase %s differs from %s", clip, video.TimeBase, firstVideo.TimeBase)
+			}
+		}
+
+		if (firstAudio == nil) != (audio == nil) {
+			return fmt.Sprintf("clip %d audio stream presence differs from clip 0", clip)
+		}
+		if firstAudio != nil {
+			switch {
+			case audio.CodecName != firstAudio.CodecName:
+				return fmt.Sprintf("clip %d audio codec %s differs from %s", clip, audio.CodecName, firstAudio.CodecName)
+			case audio.SampleRate != firstAudio.SampleRate:
+				return fmt.Sprintf("clip %d audio sample rate %s differs from %s", clip, audio.SampleRate, firstAudio.SampleRate)
+			case audio.Channels != firstAudio.Channels || audio.ChannelLayout != firstAudio.ChannelLayout:
+				return fmt.Sprintf("clip %d audio layout %s differs from %s", clip, audio.ChannelLayout, firstAudio.ChannelLayout)
+			}
+		}
+	}
+	return ""
+}
+
+// mergeTarget holds the output parameters that every clip is normalized to by the concat filter
+type mergeTarget struct {
+	Video             bool
+	Width             int
+	Height            int
+	FrameRate         float64
+	Audio             bool
+	NormalizeLoudness bool
+}
+
+// filterReason returns why the options alone require the concat filter, or an empty string if they don't
+func (o MergeOptions) filterReason() string {
+	switch {
+	case o.AudioOnly:
+		return "audio-only output requested"
+	case o.NormalizeLoudness:
+		return "loudness normalization requested"
+	case !o.Range.IsZero():
+		// a stream copy can only cut on keyframes
+		return "time range requested"
+	}
+	return ""
+}
+
+// newMergeTarget uses the first clip with video as the reference for resolution and frame rate.
+// The output carries audio when at least one clip has an audio track; clips without one are padded with silence.
+func newMergeTarget(probes []MediaProbe, options MergeOptions) (mergeTarget, error) {
+	target := mergeTarget{Video: !options.AudioOnly, FrameRate: defaultMergeFrameRate, NormalizeLoudness: options.NormalizeLoudness}
+	for _, p := range probes {
+		if p.AudioStream() != nil {
+			target.Audio = true
+		}
+		if target.Width != 0 {
+			continue
+		}
+		if video := p.VideoStream(); video != nil && video.Width > 0 && video.Height > 0 {
+			// libx264 with yuv420p requires even dimensions
+			target.Width = video.Width &^ 1
+			target.Height = video.Height &^ 1
+			if fps := frameRate(video.RFrameRate); fps > 0 {
+				target.FrameRate = fps
+			}
+		}
+	}
+
+	if options.AudioOnly && !target.Audio {
+		return target, errors.New("audio-only output requested but none of the files to merge contain an audio stream")
+	}
+	if target.Video && target.Width == 0 {
+		return target, errors.New("none of the files to merge contain a video stream")
+	}
+	for i, p := range probes {
+		if target.Audio && p.AudioStream() == nil && p.Duration() <= 0 {
+			return target, fmt.Errorf("clip %d has no audio stream and no known duration to generate silence for", i)
+		}
+		if target.Video && p.VideoStream() == nil {
+			return target, fmt.Errorf("clip %d has no video stream", i)
+		}
+	}
+	return target, nil
+}
+
+// concatFilterGraph builds a filter_complex that scales, pads and resamples every input to the target
+// before joining them with the concat filter. Clips without audio contribute silence of the same duration.
+// The outputs are labelled [outv] and [outa].
+func concatFilterGraph(probes []MediaProbe, target mergeTarget) string {
+	var graph strings.Builder
+	var concatInputs strings.Builder
+
+	for i, p := range probes {
+		if target.Video {
+			fmt.Fprintf(&graph, "[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%s,format=yuv420p[v%d];",
+				i, target.Width, target.Height, target.Width, target.Height, formatFrameRate(target.FrameRate), i)
+			fmt.Fprintf(&concatInputs, "[v%d]", i)
+		}
+		if !target.Audio {
+			continue
+		}
+		switch {
+		case p.AudioStream() == nil:
+			fmt.Fprintf(&graph, "anullsrc=r=%d:cl=%s,atrim=duration=%s[a%d];",
+				mergeAudioSampleRate, mergeAudioChannelLayout, strconv.FormatFloat(p.Duration(), 'f', -1, 64), i)
+		case target.NormalizeLoudness:
+			// loudnorm upsamples internally, so resample back to the target rate afterwards
+			fmt.Fprintf(&graph, "[%d:a]%s,aresample=%d,aformat=sample_fmts=fltp:channel_layouts=%s[a%d];",
+				i, loudnessTargetFilter, mergeAudioSampleRate, mergeAudioChannelLayout, i)
+		default:
+			fmt.Fprintf(&graph, "[%d:a]aresample=%d,aformat=sample_fmts=fltp:channel_layouts=%s[a%d];",
+				i, mergeAudioSampleRate, mergeAudioChannelLayout, i)
+		}
+		fmt.Fprintf(&concatInputs, "[a%d]", i)
+	}
+
+	videoOutputs, audioOutputs := 0, 0
+	outputs := ""
+	if target.Video {
+		videoOutputs = 1
+		outputs += "[outv]"
+	}
+	if target.Audio {
+		audioOutputs = 1
+		outputs += "[outa]"
+	}
+	fmt.Fprintf(&graph, "%sconcat=n=%d:v=%d:a=%d%s", concatInputs.String(), len(probes), videoOutputs, audioOutputs, outputs)
+	return graph.String()
+}
+
+// concatFilterArgs returns the ffmpeg arguments that merge fileNames through the concat filter
+func concatFilterArgs(fileNames []string, probes []MediaProbe, target mergeTarget, outputFileName string) []string {
+	args := []string{}
+	for _, f := range fileNames {
+		args = append(args, "-i", f)
+	}
+	args = append(args, "-filter_complex", concatFilterGraph(probes, target))
+	if target.Video {
+		args = append(args, "-map", "[outv]", "-c:v", "libx264", "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, "-vn")
+	}
+	if target.Audio {
+		args = append(args, "-map", "[outa]", "-c:a", "aac")
+	}
+	return append(args, outputFileName)
+}
+
+// concatListEntry returns the concat demuxer list line for path. Single quotes cannot appear inside a
+// quoted string, so each one closes the quote, adds an escaped quote and reopens it.
+func concatListEntry(path string) (string, error) {
+	if strings.ContainsAny(path, "\n\r") {
+		return "", fmt.Errorf("file name %q cannot be written to a concat list", path)
+	}
+	return fmt.Sprintf("file '%s'\n", strings.Replace(path, "'", `'\''`, -1)), nil
+}
+
+func formatFrameRate(fps float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", fps), "0"), ".")
+}
@@ -0,0 +1,103 @@
+package media_processing_workflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testProbe(codec string, width, height int, fps string, withAudio bool) MediaProbe {
+	probe := MediaProbe{Streams: []ProbeStream{
+		{CodecType: "video", CodecName: codec, Width: width, Height: height, PixFmt: "yuv420p", RFrameRate: fps, TimeBase: "1/15360"},
+	}}
+	if withAudio {
+		probe.Streams = append(probe.Streams, ProbeStream{CodecType: "audio", CodecName: "aac", SampleRate: "48000", Channels: 2, ChannelLayout: "stereo"})
+	}
+	return probe
+}
+
+func Test_ConcatMismatch(t *testing.T) {
+	same := testProbe("h264", 1920, 1080, "30/1", true)
+	assert.Empty(t, concatMismatch([]MediaProbe{same, same}))
+	assert.Contains(t, concatMismatch([]MediaProbe{same, testProbe("h264", 1280, 720, "30/1", true)}), "resolution")
+	assert.Contains(t, concatMismatch([]MediaProbe{same, testProbe("hevc", 1920, 1080, "30/1", true)}), "video codec")
+	assert.Contains(t, concatMismatch([]MediaProbe{same, testProbe("h264", 1920, 1080, "25/1", true)}), "frame rate")
+	assert.Contains(t, concatMismatch([]MediaProbe{same, testProbe("h264", 1920, 1080, "30/1", false)}), "audio stream")
+}
+
+func Test_ConcatFilterGraph(t *testing.T) {
+	probes := []MediaProbe{testProbe("h264", 1281, 721, "30000/1001", true), testProbe("hevc", 640, 480, "25/1", true)}
+	target, err := newMergeTarget(probes, MergeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, mergeTarget{Video: true, Width: 1280, Height: 720, FrameRate: 30000.0 / 1001, Audio: true}, target)
+
+	graph := concatFilterGraph(probes, target)
+	assert.Contains(t, graph, "[1:v]scale=1280:720:force_original_aspect_ratio=decrease,pad=1280:720:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=29.97,format=yuv420p[v1];")
+	assert.Contains(t, graph, "[1:a]aresample=48000")
+	assert.Contains(t, graph, "[v0][a0][v1][a1]concat=n=2:v=1:a=1[outv][outa]")
+
+	target.Audio = false
+	assert.Contains(t, concatFilterGraph(probes, target), "[v0][v1]concat=n=2:v=1:a=0[outv]")
+}
+
+func Test_ConcatFilterGraph_Audio(t *testing.T) {
+	silent := testProbe("h264", 1280, 720, "30/1", false)
+	silent.Format.Duration = "12.500000"
+	probes := []MediaProbe{testProbe("h264", 1280, 720, "30/1", true), silent}
+
+	target, err := newMergeTarget(probes, MergeOptions{NormalizeLoudness: true})
+	assert.NoError(t, err)
+	graph := concatFilterGraph(probes, target)
+	assert.Contains(t, graph, "[0:a]loudnorm=I=-23:LRA=7:TP=-2,aresample=48000")
+	assert.Contains(t, graph, "anullsrc=r=48000:cl=stereo,atrim=duration=12.5[a1];")
+
+	target, err = newMergeTarget(probes, MergeOptions{AudioOnly: true})
+	assert.NoError(t, err)
+	graph = concatFilterGraph(probes, target)
+	assert.NotContains(t, graph, ":v]")
+	assert.Contains(t, graph, "[a0][a1]concat=n=2:v=0:a=1[outa]")
+
+	_, err = newMergeTarget([]MediaProbe{silent}, MergeOptions{AudioOnly: true})
+	assert.Error(t, err)
+}
+
+func Test_WritefileNamesToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concatlist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	listFile := filepath.Join(dir, "filesToMerge.txt")
+	assert.NoError(t, writefileNamesToFile(listFile, []string{"/tmp/first.mp4", "/tmp/second.mp4", "/tmp/third.mp4"}))
+	assert.NoError(t, writefileNamesToFile(listFile, []string{"/tmp/it's.mp4"}))
+
+	contents, err := ioutil.ReadFile(listFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "file '/tmp/it'\\''s.mp4'\n", string(contents))
+
+	_, err = concatListEntry("/tmp/new\nline.mp4")
+	assert.Error(t, err)
+}
+
+func Test_ParseClipRange(t *testing.T) {
+	r, err := ParseClipRange("2s-1m30s")
+	assert.NoError(t, err)
+	assert.Equal(t, ClipRange{Start: 2 * time.Second, End: 90 * time.Second}, r)
+	assert.Equal(t, []string{"-ss", "2", "-to", "90"}, r.outputArgs())
+
+	r, err = ParseClipRange("1.5s-")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ss", "1.5"}, r.outputArgs())
+
+	r, err = ParseClipRange("")
+	assert.NoError(t, err)
+	assert.True(t, r.IsZero())
+
+	_, err = ParseClipRange("10s-5s")
+	assert.Error(t, err)
+	_, err = ParseClipRange("10s")
+	assert.Error(t, err)
+}
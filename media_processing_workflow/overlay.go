@@ -0,0 +1,184 @@
+package media_processing_workflow
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// overlay positions
+	OverlayTopLeft     = "top-left"
+	OverlayTopRight    = "top-right"
+	OverlayBottomLeft  = "bottom-left"
+	OverlayBottomRight = "bottom-right"
+	OverlayCenter      = "center"
+
+	defaultOverlayFontSize = 24
+	overlayMargin          = 10
+
+	// timestampPlaceholder marks where the running timestamp expression goes once the template is rendered
+	timestampPlaceholder = "\x00timestamp\x00"
+)
+
+// EncodingProfile describes how each downloaded clip is encoded
+type EncodingProfile struct {
+	// Overlay is burned into the encoded video when set
+	Overlay *Overlay
+}
+
+// Overlay burns a text template and/or an image watermark into the video
+type Overlay struct {
+	// Text is a text/template rendered with OverlayData, e.g. "{{.DeviceID}} #{{.ClipIndex}} {{.Timestamp}}"
+	Text string
+	// ImagePath is the path of a watermark image on the worker host
+	ImagePath string
+	// Position is one of the Overlay* position constants; defaults to bottom-right
+	Position string
+	// Opacity ranges over (0, 1], 1 being opaque; zero means the default of 1
+	Opacity float64
+	// FontSize of the text overlay in pixels; defaults to 24
+	FontSize int
+	// FontFile is the font used for the text overlay; ffmpeg's default font is used when empty
+	FontFile string
+}
+
+// OverlayData is the data available to the Overlay text template
+type OverlayData struct {
+	DeviceID  string
+	ClipIndex int
+	// Timestamp renders as the wall-clock time of the current frame, counting from the clip's capture time
+	// when the recording carries one and from the start of the clip otherwise
+	Timestamp string
+}
+
+// EncodeParams are the per-clip inputs of EncodeFileActivity
+type EncodeParams struct {
+	DeviceID  string
+	ClipIndex int
+	Profile   EncodingProfile
+	// Range trims the clip to the selected window; the zero value keeps the whole clip
+	Range ClipRange
+}
+
+// Validate checks the overlay settings without rendering them
+func (o Overlay) Validate() error {
+	if o.Text == "" && o.ImagePath == "" {
+		return fmt.Errorf("overlay requires text or an image")
+	}
+	if _, err := template.New("overlay").Parse(o.Text); err != nil {
+		return fmt.Errorf("invalid overlay text template: %v", err)
+	}
+	if _, ok := overlayPositions[o.position()]; !ok {
+		return fmt.Errorf("unknown overlay position %q", o.Position)
+	}
+	if o.Opacity < 0 || o.Opacity > 1 {
+		return fmt.Errorf("overlay opacity %v is outside of [0, 1]", o.Opacity)
+	}
+	return nil
+}
+
+func (o Overlay) position() string {
+	if o.Position == "" {
+		return OverlayBottomRight
+	}
+	return o.Position
+}
+
+func (o Overlay) opacity() float64 {
+	if o.Opacity == 0 {
+		return 1
+	}
+	return o.Opacity
+}
+
+// overlayPositions maps each position to the x:y expressions of the drawtext and overlay filters
+var overlayPositions = map[string][2]string{
+	OverlayTopLeft:     {fmt.Sprintf("x=%[1]d:y=%[1]d", overlayMargin), fmt.Sprintf("x=%[1]d:y=%[1]d", overlayMargin)},
+	OverlayTopRight:    {fmt.Sprintf("x=w-tw-%[1]d:y=%[1]d", overlayMargin), fmt.Sprintf("x=W-w-%[1]d:y=%[1]d", overlayMargin)},
+	OverlayBottomLeft:  {fmt.Sprintf("x=%[1]d:y=h-th-%[1]d", overlayMargin), fmt.Sprintf("x=%[1]d:y=H-h-%[1]d", overlayMargin)},
+	OverlayBottomRight: {fmt.Sprintf("x=w-tw-%[1]d:y=h-th-%[1]d", overlayMargin), fmt.Sprintf("x=W-w-%[1]d:y=H-h-%[1]d", overlayMargin)},
+	OverlayCenter:      {"x=(w-tw)/2:y=(h-th)/2", "x=(W-w)/2:y=(H-h)/2"},
+}
+
+// overlayText renders the text template. The result is meant for drawtext with expansion enabled, so
+// everything but the timestamp expression is escaped. offset is the position within the recording of the first
+// encoded frame, which is non-zero when the clip is trimmed.
+func (o Overlay) overlayText(deviceID string, clipIndex int, captureTime time.Time, offset time.Duration) (string, error) {
+	tmpl, err := template.New("overlay").Parse(o.Text)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, OverlayData{DeviceID: deviceID, ClipIndex: clipIndex, Timestamp: timestampPlaceholder})
+	if err != nil {
+		return "", err
+	}
+
+	// the text is read from a file, so only the expansion syntax applies: colons within the strftime
+	// format are escaped because they would otherwise separate the arguments of the pts function
+	timestamp := fmt.Sprintf(`%%{pts:hms:%s}`, ffmpegSeconds(offset))
+	if !captureTime.IsZero() {
+		start := captureTime.Add(offset).Round(time.Millisecond)
+		epoch := strconv.FormatFloat(float64(start.UnixNano())/float64(time.Second), 'f', -1, 64)
+		timestamp = fmt.Sprintf(`%%{pts:gmtime:%s:%%Y-%%m-%%d %%H\:%%M\:%%S} UTC`, epoch)
+	}
+	text := strings.NewReplacer(`\`, `\\`, `%`, `\%`).Replace(rendered.String())
+	return strings.Replace(text, timestampPlaceholder, timestamp, -1), nil
+}
+
+// videoFilter returns the -vf filtergraph that applies the overlay. textFile holds the rendered overlay text.
+func (o Overlay) videoFilter(textFile string) string {
+	positions := overlayPositions[o.position()]
+	opacity := strconv.FormatFloat(o.opacity(), 'f', -1, 64)
+	filters := []string{}
+
+	if o.ImagePath != "" {
+		filters = append(filters, fmt.Sprintf("movie=%s,format=rgba,colorchannelmixer=aa=%s[watermark]",
+			escapeFilterValue(o.ImagePath), opacity))
+		filters = append(filters, fmt.Sprintf("[in][watermark]overlay=%s[marked]", positions[1]))
+	}
+
+	if textFile != "" {
+		fontSize := o.FontSize
+		if fontSize == 0 {
+			fontSize = defaultOverlayFontSize
+		}
+		drawtext := fmt.Sprintf("drawtext=textfile=%s:expansion=normal:fontsize=%d:fontcolor=white@%s:box=1:boxcolor=black@%s:boxborderw=4:%s",
+			escapeFilterValue(textFile), fontSize, opacity, strconv.FormatFloat(o.opacity()/2, 'f', -1, 64), positions[0])
+		if o.FontFile != "" {
+			drawtext += ":fontfile=" + escapeFilterValue(o.FontFile)
+		}
+		input := "[in]"
+		if o.ImagePath != "" {
+			input = "[marked]"
+		}
+		filters = append(filters, input+drawtext+"[out]")
+	} else {
+		filters[len(filters)-1] = strings.Replace(filters[len(filters)-1], "[marked]", "[out]", 1)
+	}
+
+	return strings.Join(filters, ";")
+}
+
+// escapeFilterValue quotes a value so that it can be used as a filter option inside a filtergraph
+func escapeFilterValue(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(escaped)
+}
+
+// captureTime returns the creation time recorded in the container metadata, if any
+func captureTime(probe MediaProbe) time.Time {
+	created, ok := probe.Format.Tags["creation_time"]
+	if !ok {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,41 @@
+package media_processing_workflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OverlayText(t *testing.T) {
+	overlay := Overlay{Text: "{{.DeviceID}} #{{.ClipIndex}} {{.Timestamp}}"}
+
+	text, err := overlay.overlayText(`cam%1\a`, 2, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, `cam\%1\\a #2 %{pts:hms:0}`, text)
+
+	captured := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	text, err = overlay.overlayText("cam", 0, captured, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, `cam #0 %{pts:gmtime:1609556645:%Y-%m-%d %H\:%M\:%S} UTC`, text)
+
+	text, err = overlay.overlayText("cam", 0, captured, 1500*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, `cam #0 %{pts:gmtime:1609556646.5:%Y-%m-%d %H\:%M\:%S} UTC`, text)
+}
+
+func Test_OverlayVideoFilter(t *testing.T) {
+	overlay := Overlay{Text: "{{.DeviceID}}", Position: OverlayTopLeft}
+	assert.NoError(t, overlay.Validate())
+	assert.Equal(t, `[in]drawtext=textfile=/tmp/ws/overlay-0.txt:expansion=normal:fontsize=24:fontcolor=white@1:box=1:boxcolor=black@0.5:boxborderw=4:x=10:y=10[out]`,
+		overlay.videoFilter("/tmp/ws/overlay-0.txt"))
+
+	watermark := Overlay{ImagePath: "/etc/logo's.png", Opacity: 0.4}
+	assert.NoError(t, watermark.Validate())
+	assert.Equal(t, `movie=/etc/logo\\\'s.png,format=rgba,colorchannelmixer=aa=0.4[watermark];[in][watermark]overlay=x=W-w-10:y=H-h-10[out]`,
+		watermark.videoFilter(""))
+
+	assert.Error(t, Overlay{}.Validate())
+	assert.Error(t, Overlay{Text: "{{.Missing"}.Validate())
+	assert.Error(t, Overlay{Text: "x", Position: "middle"}.Validate())
+}
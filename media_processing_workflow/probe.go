@@ -0,0 +1,101 @@
+package media_processing_workflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MediaProbe is the subset of the ffprobe json output that the activities rely on
+type MediaProbe struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+}
+
+// ProbeStream describes a single audio or video stream of a media file
+type ProbeStream struct {
+	CodecType     string `json:"codec_type"`
+	CodecName     string `json:"codec_name"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	PixFmt        string `json:"pix_fmt"`
+	RFrameRate    string `json:"r_frame_rate"`
+	TimeBase      string `json:"time_base"`
+	SampleRate    string `json:"sample_rate"`
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channel_layout"`
+}
+
+// ProbeFormat describes the container of a media file
+type ProbeFormat struct {
+	FormatName string            `json:"format_name"`
+	Duration   string            `json:"duration"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// ProbeMedia runs ffprobe against the provided file and parses its stream and format information
+func ProbeMedia(ctx context.Context, fileName string) (MediaProbe, error) {
+	var probe MediaProbe
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, FFprobeCommand, "-v", "error", "-print_format", "json", "-show_streams", "-show_format", fileName)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return probe, fmt.Errorf("ffprobe failed for %s: %w: %s", fileName, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return probe, fmt.Errorf("unable to parse ffprobe output for %s: %v", fileName, err)
+	}
+	return probe, nil
+}
+
+// VideoStream returns the first video stream of the media, or nil if there is none
+func (p MediaProbe) VideoStream() *ProbeStream {
+	return p.firstStream("video")
+}
+
+// AudioStream returns the first audio stream of the media, or nil if there is none
+func (p MediaProbe) AudioStream() *ProbeStream {
+	return p.firstStream("audio")
+}
+
+func (p MediaProbe) firstStream(codecType string) *ProbeStream {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == codecType {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+// Duration returns the container duration in seconds; zero when ffprobe could not determine it
+func (p MediaProbe) Duration() float64 {
+	d, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// frameRate parses an ffprobe rational such as "30000/1001" into frames per second
+func frameRate(rational string) float64 {
+	parts := strings.SplitN(rational, "/", 2)
+	num, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 1 {
+		return num
+	}
+	den, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
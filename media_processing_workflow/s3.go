@@ -0,0 +1,295 @@
+package media_processing_workflow
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	s3Service       = "s3"
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	// emptyPayloadHash is the SHA-256 of an empty body, signed for requests without a payload
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// s3ContentHashMetadata records the SHA-256 of the content with the object, so a retried put recognizes its own
+	// object
+	s3ContentHashMetadata = "X-Amz-Meta-Content-Sha256"
+)
+
+// S3Config configures the S3 compatible object store used by s3:// destinations
+type S3Config struct {
+	// Endpoint is the base URL of the object store, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	// Buckets are addressed path-style, which every S3 compatible store supports.
+	Endpoint string
+	// Region the requests are signed for; defaults to us-east-1
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+func (c S3Config) region() string {
+	if c.Region == "" {
+		return defaultS3Region
+	}
+	return c.Region
+}
+
+// s3Destination puts the output as an object named after the file below the prefix of the bucket. Unless
+// overwrite is set, the put is conditional on the object not existing; an existing object recorded with the same
+// content hash was put by an earlier attempt and is kept.
+type s3Destination struct {
+	config S3Config
+	client *http.Client
+	bucket string
+	prefix string
+}
+
+func (d *s3Destination) Store(ctx context.Context, fileName string, metadata UploadMetadata, overwrite bool) (UploadResult, error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return UploadResult{}, err
+	}
+	// the payload is signed, so the object store verifies the content it receives
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fh); err != nil {
+		return UploadResult{}, err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return UploadResult{}, err
+	}
+
+	base := filepath.Base(fileName)
+	key := path.Join(d.prefix, base)
+	objectURL, err := d.objectURL(key)
+	if err != nil {
+		return UploadResult{}, temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidDestination, nil)
+	}
+
+	body := newProgressReader(fh)
+	stop := heartbeatUntilStopped(ctx, func() interface{} { return UploadProgress{Offset: body.BytesRead()} })
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), ioutil.NopCloser(body))
+	if err != nil {
+		return UploadResult{}, err
+	}
+	req.ContentLength = info.Size()
+	contentType := mime.TypeByExtension(filepath.Ext(base))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	// the metadata is stored as user-defined object metadata
+	if metadata.DeviceID != "" {
+		req.Header.Set("X-Amz-Meta-Device-Id", metadata.DeviceID)
+	}
+	if metadata.WorkflowID != "" {
+		req.Header.Set("X-Amz-Meta-Workflow-Id", metadata.WorkflowID)
+	}
+	req.Header.Set(s3ContentHashMetadata, payloadHash)
+	if !overwrite {
+		req.Header.Set("If-None-Match", "*")
+	}
+	signV4(req, d.config.AccessKeyID, d.config.SecretAccessKey, d.config.region(), s3Service, payloadHash, time.Now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer resp.Body.Close()
+	location := url.URL{Scheme: DestinationSchemeS3, Host: d.bucket, Path: "/" + key}
+	result := UploadResult{ID: key, FileName: base, Location: location.String(), Size: info.Size()}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return result, nil
+	case resp.StatusCode == http.StatusPreconditionFailed && !overwrite:
+		existingHash, err := d.contentHash(ctx, objectURL)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		if existingHash == payloadHash {
+			return result, nil
+		}
+		return UploadResult{}, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("object %s already exists in bucket %s", key, d.bucket), ErrTypeOutputExists, nil)
+	default:
+		return UploadResult{}, s3ResponseError(resp)
+	}
+}
+
+// contentHash returns the content hash an object was put with, or "" when it was put by someone else
+func (d *s3Destination) contentHash(ctx context.Context, objectURL *url.URL) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, objectURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	signV4(req, d.config.AccessKeyID, d.config.SecretAccessKey, d.config.region(), s3Service, emptyPayloadHash, time.Now())
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3ResponseError(resp)
+	}
+	return resp.Header.Get(s3ContentHashMetadata), nil
+}
+
+// objectURL returns the path-style URL of the object. The path is encoded the way it is signed, so that the object
+// store derives the same canonical request from it.
+func (d *s3Destination) objectURL(key string) (*url.URL, error) {
+	endpoint, err := url.Parse(d.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("the S3 endpoint %q is not an http(s) URL", d.config.Endpoint)
+	}
+	u := *endpoint
+	u.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + d.bucket + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	return &u, nil
+}
+
+// s3ErrorResponse is the XML body of a failed S3 request
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3ResponseError classifies a failed S3 response. Besides the upload errors, denied requests and missing buckets
+// are not retried: they need the configuration of the worker or the object store to change.
+func s3ResponseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	message := strings.TrimSpace(string(body))
+	var s3Err s3ErrorResponse
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		message = s3Err.Code + ": " + s3Err.Message
+	}
+	message = fmt.Sprintf("putting object failed with %s: %s", resp.Status, message)
+
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound:
+		return temporal.NewNonRetryableApplicationError(message, ErrTypeUploadRejected, nil)
+	default:
+		return uploadStatusError(resp.StatusCode, message)
+	}
+}
+
+// signV4 adds AWS Signature Version 4 headers to the request. Every header set on the request so far is signed,
+// along with the host; payloadHash is the hex encoded SHA-256 of the body.
+// See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signV4(req *http.Request, accessKeyID, secretAccessKey, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		sigV4Algorithm, accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes the query parameters sorted by name and value
+func canonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes every byte except the unreserved characters, and the slashes of a path
+func uriEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
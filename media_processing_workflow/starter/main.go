@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
 	"github.com/pborman/uuid"
@@ -29,8 +31,50 @@ func main() {
 	outputFileName := fmt.Sprintf("mergedFile_%s.mp4", fileID)
 
 	deviceIdPtr := flag.String("deviceId", "deviceId", "a device id")
+	overwritePtr := flag.Bool("overwrite", false, "replace the merged output file if it already exists at a directory or S3 destination")
+	loudnessPtr := flag.Bool("normalizeLoudness", false, "apply EBU R128 loudness normalization to every clip")
+	audioOnlyPtr := flag.Bool("audioOnly", false, "produce an audio-only merged output")
+	overlayTextPtr := flag.String("overlayText", "", "text template burned into the video, e.g. '{{.DeviceID}} #{{.ClipIndex}} {{.Timestamp}}'")
+	watermarkPtr := flag.String("watermark", "", "path of a watermark image on the worker host")
+	overlayPositionPtr := flag.String("overlayPosition", media_processing_workflow.OverlayBottomRight, "overlay position: top-left, top-right, bottom-left, bottom-right or center")
+	overlayOpacityPtr := flag.Float64("overlayOpacity", 1, "overlay opacity above 0 and up to 1 (opaque); 0 means opaque as well")
+	clipRangesPtr := flag.String("clipRanges", "", "comma separated START-END ranges applied to each clip in order, e.g. '2s-10s,,5s-'")
+	timeRangePtr := flag.String("timeRange", "", "START-END range applied to the merged timeline, e.g. '30s-2m'")
+	retainHoursPtr := flag.Int("retainHours", 0, "keep the local artifacts on the worker host for this many hours for debugging")
+	destinationPtr := flag.String("destination", "", "URI the merged output is stored at, e.g. file:///mnt/media or s3://bucket/prefix; defaults to the internal API")
+	flag.Parse()
 
-	we, err := c.ExecuteWorkflow(context.Background(), workflowOptions, media_processing_workflow.MediaProcessingWorkflow, *deviceIdPtr, outputFileName)
+	options := media_processing_workflow.MediaProcessingOptions{
+		Overwrite:          *overwritePtr,
+		NormalizeLoudness:  *loudnessPtr,
+		AudioOnly:          *audioOnlyPtr,
+		Destination:        *destinationPtr,
+		RetainArtifactsFor: time.Duration(*retainHoursPtr) * time.Hour,
+	}
+	if *overlayTextPtr != "" || *watermarkPtr != "" {
+		options.EncodingProfile.Overlay = &media_processing_workflow.Overlay{
+			Text:      *overlayTextPtr,
+			ImagePath: *watermarkPtr,
+			Position:  *overlayPositionPtr,
+			Opacity:   *overlayOpacityPtr,
+		}
+	}
+
+	if *clipRangesPtr != "" {
+		for _, value := range strings.Split(*clipRangesPtr, ",") {
+			clipRange, err := media_processing_workflow.ParseClipRange(strings.TrimSpace(value))
+			if err != nil {
+				log.Fatalln("Invalid clip range", err)
+			}
+			options.ClipRanges = append(options.ClipRanges, clipRange)
+		}
+	}
+	options.TimeRange, err = media_processing_workflow.ParseClipRange(*timeRangePtr)
+	if err != nil {
+		log.Fatalln("Invalid time range", err)
+	}
+
+	we, err := c.ExecuteWorkflow(context.Background(), workflowOptions, media_processing_workflow.MediaProcessingWorkflow, *deviceIdPtr, outputFileName, options)
 	if err != nil {
 		log.Fatalln("Unable to execute workflow", err)
 	}
@@ -0,0 +1,84 @@
+package media_processing_workflow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClipRange selects a window of a clip, or of the merged timeline. The zero value selects everything.
+type ClipRange struct {
+	// Start is the in point; zero starts at the beginning
+	Start time.Duration
+	// End is the out point; zero runs until the end
+	End time.Duration
+}
+
+// IsZero reports whether the range selects the whole input
+func (r ClipRange) IsZero() bool {
+	return r.Start == 0 && r.End == 0
+}
+
+// Validate checks that the in point precedes the out point
+func (r ClipRange) Validate() error {
+	if r.Start < 0 || r.End < 0 {
+		return fmt.Errorf("clip range %v-%v has a negative point", r.Start, r.End)
+	}
+	if r.End != 0 && r.End <= r.Start {
+		return fmt.Errorf("clip range end %v is not after start %v", r.End, r.Start)
+	}
+	return nil
+}
+
+// Duration returns the length of the range, or zero when it runs until the end of the input
+func (r ClipRange) Duration() time.Duration {
+	if r.End == 0 {
+		return 0
+	}
+	return r.End - r.Start
+}
+
+// ParseClipRange parses "START-END" where both points are Go durations and either may be omitted,
+// e.g. "2s-1m30s", "-10s" or "45s-". An empty string selects everything.
+func ParseClipRange(value string) (ClipRange, error) {
+	var r ClipRange
+	if value == "" {
+		return r, nil
+	}
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("clip range %q is not of the form START-END", value)
+	}
+
+	var err error
+	if parts[0] != "" {
+		if r.Start, err = time.ParseDuration(parts[0]); err != nil {
+			return r, err
+		}
+	}
+	if parts[1] != "" {
+		if r.End, err = time.ParseDuration(parts[1]); err != nil {
+			return r, err
+		}
+	}
+	return r, r.Validate()
+}
+
+// outputArgs returns the ffmpeg output options that trim the output timeline to the range. As output options,
+// -ss and -to decode and discard frames up to the in point, which keeps the cut frame-accurate when re-encoding.
+func (r ClipRange) outputArgs() []string {
+	args := []string{}
+	if r.Start > 0 {
+		args = append(args, "-ss", ffmpegSeconds(r.Start))
+	}
+	if r.End > 0 {
+		args = append(args, "-to", ffmpegSeconds(r.End))
+	}
+	return args
+}
+
+// ffmpegSeconds formats d as the decimal seconds accepted by ffmpeg time options
+func ffmpegSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
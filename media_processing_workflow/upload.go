@@ -0,0 +1,381 @@
+package media_processing_workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+const (
+	// DefaultUploadChunkSize is the size of the chunks sent through the resumable upload protocol.
+	// Files no larger than one chunk are sent as a single multipart upload.
+	DefaultUploadChunkSize = 8 * 1024 * 1024 // 8 MB
+)
+
+var (
+	// uploadHeartbeatInterval is how often the upload progress is reported to the Temporal service
+	uploadHeartbeatInterval = 5 * time.Second
+	// recordHeartbeat reports the upload progress; replaced in tests
+	recordHeartbeat = activity.RecordHeartbeat
+)
+
+// defaultUploadClient bounds every phase of an upload except the transfer of the body itself,
+// which may legitimately take a long time for large files and is bounded by the activity timeouts instead.
+var defaultUploadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+func (a *Activities) httpClient() *http.Client {
+	if a.HTTPClient != nil {
+		return a.HTTPClient
+	}
+	return defaultUploadClient
+}
+
+// UploadParams holds the parameters of UploadFileActivity
+type UploadParams struct {
+	// Destination is the URI the file is stored at, e.g. file:///mnt/media or s3://bucket/prefix;
+	// empty stores it through the internal API
+	Destination string
+	// DeviceID is the device the media was recorded by
+	DeviceID string
+	// Overwrite allows the file to replace a file of the same name at destinations that store files by name; without
+	// it, such a file fails the upload with a non-retryable OutputExists error. The internal API rejects it.
+	Overwrite bool
+}
+
+// UploadMetadata describes the stored file; destinations that keep metadata record it with the file
+type UploadMetadata struct {
+	DeviceID   string
+	WorkflowID string
+}
+
+// UploadResult identifies the file stored by UploadFileActivity at its destination
+type UploadResult struct {
+	// ID identifies the stored file at the destination
+	ID string
+	// FileName is the name the destination stored the file under
+	FileName string
+	// Location is where the stored file can be found
+	Location string
+	Size     int64
+}
+
+func uploadResultFromRecord(record UploadRecord) UploadResult {
+	return UploadResult{ID: record.ID, FileName: record.FileName, Location: record.Location, Size: record.Size}
+}
+
+// decodeUploadRecord reads the record of the stored file from a successful response of the internal API
+func decodeUploadRecord(resp *http.Response) (UploadResult, error) {
+	var record UploadRecord
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return UploadResult{}, fmt.Errorf("decoding the upload response: %w", err)
+	}
+	if record.ID == "" {
+		return UploadResult{}, errors.New("the upload response does not identify the stored file")
+	}
+	return uploadResultFromRecord(record), nil
+}
+
+// uploadResponseError reports a failed response of the internal API, using the message and details of its APIError body
+func uploadResponseError(action string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	message := strings.TrimSpace(string(body))
+	var apiErr APIError
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+		message = apiErr.Message
+		if len(apiErr.Details) > 0 {
+			message += " (" + strings.Join(apiErr.Details, "; ") + ")"
+		}
+	}
+	return uploadStatusError(resp.StatusCode, fmt.Sprintf("%s failed with %s: %s", action, resp.Status, message))
+}
+
+// uploadStatusError classifies a failed upload response. A request rejected as invalid, too large or unauthorized,
+// a file the server does not accept as media, or an upload over the quota of its device fails the same way on every
+// attempt, so it is not retried; other failures, such as server errors, are.
+func uploadStatusError(statusCode int, message string) error {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestEntityTooLarge:
+		return temporal.NewNonRetryableApplicationError(message, ErrTypeUploadRejected, nil)
+	case http.StatusUnprocessableEntity:
+		return temporal.NewNonRetryableApplicationError(message, ErrTypeInvalidMedia, nil)
+	case http.StatusInsufficientStorage:
+		return temporal.NewNonRetryableApplicationError(message, ErrTypeQuotaExceeded, nil)
+	default:
+		return temporal.NewApplicationError(message, ErrTypeUploadFailed)
+	}
+}
+
+// UploadProgress is recorded as the heartbeat details of UploadFileActivity
+type UploadProgress struct {
+	// UploadURL is the resumable upload being written; empty for multipart uploads
+	UploadURL string
+	// Offset is the number of bytes acknowledged by the server for resumable uploads,
+	// or the number of bytes sent so far for other uploads
+	Offset int64
+}
+
+// progressReader counts the bytes read through it; the count may be read while the reader is consumed
+type progressReader struct {
+	reader    io.Reader
+	bytesRead int64
+}
+
+func newProgressReader(reader io.Reader) *progressReader {
+	return &progressReader{reader: reader}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	atomic.AddInt64(&p.bytesRead, int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read so far
+func (p *progressReader) BytesRead() int64 {
+	return atomic.LoadInt64(&p.bytesRead)
+}
+
+// heartbeatUntilStopped records a heartbeat with the current details at the heartbeat interval until the returned
+// function is called. Unlike heartbeats driven by reading the body, these keep coming once the body has been sent,
+// while the server hashes and probes a large upload before it answers.
+func heartbeatUntilStopped(ctx context.Context, details func() interface{}) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(uploadHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				recordHeartbeat(ctx, details())
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// streamMultipartFile returns a reader producing a multipart form with the contents of file, along with the form's
+// content type. The form is generated as the reader is consumed; closing the reader stops the generation.
+func streamMultipartFile(file io.Reader, fileName string) (io.ReadCloser, string) {
+	pipeReader, pipeWriter := io.Pipe()
+	bodyWriter := multipart.NewWriter(pipeWriter)
+
+	go func() {
+		fileWriter, err := bodyWriter.CreateFormFile(FileNameAttribute, fileName)
+		if err == nil {
+			_, err = io.Copy(fileWriter, file)
+		}
+		if err == nil {
+			err = bodyWriter.Close()
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return pipeReader, bodyWriter.FormDataContentType()
+}
+
+// uploadIdempotencyKey identifies the upload of fileName by the current workflow run, so that the internal API
+// stores the file once however often the activity is retried
+func uploadIdempotencyKey(ctx context.Context, fileName string) string {
+	execution := activity.GetInfo(ctx).WorkflowExecution
+	return execution.ID + "/" + execution.RunID + "/" + filepath.Base(fileName)
+}
+
+// resumableUpload sends the file in chunks through the resumable upload protocol. The upload URL and the
+// acknowledged offset are recorded as heartbeat details, so a retried activity continues where the previous
+// attempt stopped instead of starting from the first byte.
+func (d *internalAPIDestination) resumableUpload(ctx context.Context, file *os.File, size int64, idempotencyKey string, metadata UploadMetadata) (UploadResult, error) {
+	logger := activity.GetLogger(ctx)
+
+	var progress UploadProgress
+	if activity.HasHeartbeatDetails(ctx) {
+		if err := activity.GetHeartbeatDetails(ctx, &progress); err != nil {
+			progress = UploadProgress{}
+		}
+	}
+
+	if progress.UploadURL != "" {
+		offset, err := d.resumableUploadOffset(ctx, progress.UploadURL)
+		if err != nil {
+			logger.Warn("unable to resume upload; starting a new one", "uploadURL", progress.UploadURL, "Error", err)
+			progress = UploadProgress{}
+		} else {
+			logger.Info("resuming upload", "uploadURL", progress.UploadURL, "offset", offset)
+			progress.Offset = offset
+		}
+	}
+	if progress.UploadURL == "" {
+		uploadURL, stored, err := d.createResumableUpload(ctx, size, idempotencyKey, metadata)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		if stored != nil {
+			logger.Info("file was already uploaded", "idempotencyKey", idempotencyKey)
+			return *stored, nil
+		}
+		progress = UploadProgress{UploadURL: uploadURL}
+		logger.Info("created resumable upload", "uploadURL", uploadURL)
+	}
+	activity.RecordHeartbeat(ctx, progress)
+
+	chunkSize := d.chunkSize
+	for progress.Offset < size {
+		length := size - progress.Offset
+		if length > chunkSize {
+			length = chunkSize
+		}
+		offset, stored, err := d.appendResumableChunk(ctx, progress, io.NewSectionReader(file, progress.Offset, length), length)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		if stored != nil {
+			return *stored, nil
+		}
+		progress.Offset = offset
+		activity.RecordHeartbeat(ctx, progress)
+	}
+
+	// the previous attempt sent the last chunk but did not receive the record; creating the upload
+	// again with the same idempotency key returns it
+	_, stored, err := d.createResumableUpload(ctx, size, idempotencyKey, metadata)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if stored != nil {
+		return *stored, nil
+	}
+	// or the server failed to store the received upload; an empty chunk at its end stores it again
+	logger.Info("completing received upload", "uploadURL", progress.UploadURL)
+	_, stored, err = d.appendResumableChunk(ctx, progress, strings.NewReader(""), 0)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if stored == nil {
+		return UploadResult{}, temporal.NewApplicationError("the completed upload was not stored", ErrTypeUploadFailed)
+	}
+	return *stored, nil
+}
+
+// createResumableUpload creates the upload for the idempotency key and returns its URL. When an earlier attempt
+// already completed the upload, the server answers 200 with the record of the stored file instead.
+func (d *internalAPIDestination) createResumableUpload(ctx context.Context, size int64, idempotencyKey string, metadata UploadMetadata) (uploadURL string, stored *UploadResult, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.resumableEndpoint, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set(UploadLengthHeader, strconv.FormatInt(size, 10))
+	setUploadHeaders(req, idempotencyKey, metadata)
+	d.authorize(ctx, req)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		result, err := decodeUploadRecord(resp)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", &result, nil
+	case http.StatusCreated:
+	default:
+		return "", nil, uploadResponseError("creating resumable upload", resp)
+	}
+
+	// the location may be relative to the endpoint
+	location, err := resp.Location()
+	if err != nil {
+		return "", nil, err
+	}
+	return location.String(), nil, nil
+}
+
+func (d *internalAPIDestination) resumableUploadOffset(ctx context.Context, uploadURL string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, uploadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	d.authorize(ctx, req)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, uploadResponseError("querying upload offset", resp)
+	}
+	return strconv.ParseInt(resp.Header.Get(UploadOffsetHeader), 10, 64)
+}
+
+// appendResumableChunk sends length bytes of chunk at progress.Offset and returns the offset stored by the server.
+// The response to the last chunk carries the record of the stored file.
+func (d *internalAPIDestination) appendResumableChunk(ctx context.Context, progress UploadProgress, chunk io.Reader, length int64) (offset int64, stored *UploadResult, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, progress.UploadURL, ioutil.NopCloser(chunk))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", OffsetOctetStreamContentType)
+	req.Header.Set(UploadOffsetHeader, strconv.FormatInt(progress.Offset, 10))
+	d.authorize(ctx, req)
+
+	// keep heartbeating the acknowledged offset while a slow chunk is in flight and, after the last chunk, while the
+	// server stores the upload
+	stop := heartbeatUntilStopped(ctx, func() interface{} { return progress })
+	resp, err := d.client.Do(req)
+	stop()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		result, err := decodeUploadRecord(resp)
+		if err != nil {
+			return 0, nil, err
+		}
+		return result.Size, &result, nil
+	case http.StatusNoContent:
+	default:
+		return 0, nil, uploadResponseError(fmt.Sprintf("uploading chunk at offset %d", progress.Offset), resp)
+	}
+	offset, err = strconv.ParseInt(resp.Header.Get(UploadOffsetHeader), 10, 64)
+	return offset, nil, err
+}
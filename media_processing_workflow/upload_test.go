@@ -0,0 +1,308 @@
+package media_processing_workflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func Test_UploadFileActivity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "merged.mp4")
+	contents := []byte("not really a video")
+	assert.NoError(t, ioutil.WriteFile(fileName, contents, 0644))
+
+	var received []byte
+	var receivedName, receivedKey, receivedDevice, receivedAPIKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the multipart body is streamed, so its length is unknown upfront
+		assert.Equal(t, int64(-1), r.ContentLength)
+		receivedKey = r.Header.Get(IdempotencyKeyHeader)
+		receivedDevice = r.Header.Get(DeviceIDHeader)
+		receivedAPIKey = r.Header.Get(APIKeyHeader)
+		file, header, err := r.FormFile(FileNameAttribute)
+		if !assert.NoError(t, err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		receivedName = header.Filename
+		received, _ = ioutil.ReadAll(file)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(UploadRecord{ID: "1", FileName: "video-1.mp4", Location: "/uploads/video-1.mp4", Size: int64(len(received))})
+	}))
+	defer server.Close()
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{FileUploadEndpoint: server.URL, UploadCredentials: UploadCredentials{APIKey: "key"}}
+	env.RegisterActivity(a)
+
+	val, err := env.ExecuteActivity(a.UploadFileActivity, fileName, UploadParams{DeviceID: "deviceId"})
+	assert.NoError(t, err)
+	assert.Equal(t, "key", receivedAPIKey)
+	assert.Equal(t, "merged.mp4", receivedName)
+	assert.Equal(t, contents, received)
+	assert.True(t, strings.HasSuffix(receivedKey, "/merged.mp4"), receivedKey)
+	assert.Equal(t, "deviceId", receivedDevice)
+
+	var result UploadResult
+	assert.NoError(t, val.Get(&result))
+	assert.Equal(t, UploadResult{ID: "1", FileName: "video-1.mp4", Location: "/uploads/video-1.mp4", Size: int64(len(contents))}, result)
+}
+
+// Test that heartbeats keep coming while the server processes the upload after the last byte was sent
+func Test_UploadFileActivity_HeartbeatsWhileServerProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "merged.mp4")
+	contents := []byte("not really a video")
+	assert.NoError(t, ioutil.WriteFile(fileName, contents, 0644))
+
+	defer func(interval time.Duration, record func(context.Context, ...interface{})) {
+		uploadHeartbeatInterval, recordHeartbeat = interval, record
+	}(uploadHeartbeatInterval, recordHeartbeat)
+	uploadHeartbeatInterval = 10 * time.Millisecond
+	var mu sync.Mutex
+	var heartbeats []UploadProgress
+	recordHeartbeat = func(ctx context.Context, details ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		heartbeats = append(heartbeats, details[0].(UploadProgress))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		// the server hashes and probes the upload before it answers
+		mu.Lock()
+		heartbeats = nil
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(UploadRecord{ID: "1", FileName: "video-1.mp4", Size: int64(len(contents))})
+	}))
+	defer server.Close()
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{FileUploadEndpoint: server.URL}
+	env.RegisterActivity(a)
+
+	_, err = env.ExecuteActivity(a.UploadFileActivity, fileName, UploadParams{DeviceID: "deviceId"})
+	assert.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(t, len(heartbeats), 3)
+	for _, heartbeat := range heartbeats {
+		assert.Equal(t, int64(len(contents)), heartbeat.Offset)
+	}
+}
+
+func Test_UploadFileActivity_ErrorResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "merged.mp4")
+	assert.NoError(t, ioutil.WriteFile(fileName, []byte("not really a video"), 0644))
+
+	tests := []struct {
+		status       int
+		nonRetryable bool
+		errType      string
+	}{
+		{http.StatusBadRequest, true, ErrTypeUploadRejected},
+		{http.StatusUnauthorized, true, ErrTypeUploadRejected},
+		{http.StatusRequestEntityTooLarge, true, ErrTypeUploadRejected},
+		{http.StatusUnprocessableEntity, true, ErrTypeInvalidMedia},
+		{http.StatusInsufficientStorage, true, ErrTypeQuotaExceeded},
+		{http.StatusInternalServerError, false, ErrTypeUploadFailed},
+		{http.StatusServiceUnavailable, false, ErrTypeUploadFailed},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			w.WriteHeader(test.status)
+			json.NewEncoder(w).Encode(APIError{Message: "rejected by the stub", Details: []string{"first problem", "second problem"}})
+		}))
+
+		var ts testsuite.WorkflowTestSuite
+		env := ts.NewTestActivityEnvironment()
+		a := &Activities{FileUploadEndpoint: server.URL}
+		env.RegisterActivity(a)
+
+		_, err = env.ExecuteActivity(a.UploadFileActivity, fileName, UploadParams{DeviceID: "deviceId"})
+		server.Close()
+
+		var appErr *temporal.ApplicationError
+		if assert.True(t, errors.As(err, &appErr), "status %d", test.status) {
+			assert.Equal(t, test.nonRetryable, appErr.NonRetryable(), "status %d", test.status)
+			assert.Equal(t, test.errType, appErr.Type(), "status %d", test.status)
+			assert.Contains(t, appErr.Error(), "rejected by the stub (first problem; second problem)")
+		}
+		// the file is kept for the next attempt
+		assert.FileExists(t, fileName)
+	}
+}
+
+// resumableStub is an in-memory server side of the resumable upload protocol for a single upload
+type resumableStub struct {
+	length  int64
+	data    []byte
+	patches []int64
+	// stored answers the creation of the upload as already completed
+	stored bool
+	// tokenSecret requires every request to carry an upload token signed with it
+	tokenSecret string
+}
+
+func (s *resumableStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.tokenSecret != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, err := VerifyUploadToken([]byte(s.tokenSecret), token, time.Now()); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(APIError{Message: err.Error()})
+			return
+		}
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/uploads":
+		if s.stored {
+			s.writeRecord(w)
+			return
+		}
+		s.length, _ = strconv.ParseInt(r.Header.Get(UploadLengthHeader), 10, 64)
+		w.Header().Set("Location", "/uploads/1")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead && r.URL.Path == "/uploads/1":
+		w.Header().Set(UploadOffsetHeader, strconv.Itoa(len(s.data)))
+	case r.Method == http.MethodPatch && r.URL.Path == "/uploads/1":
+		offset, _ := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+		if offset != int64(len(s.data)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		chunk, _ := ioutil.ReadAll(r.Body)
+		s.data = append(s.data, chunk...)
+		s.patches = append(s.patches, offset)
+		w.Header().Set(UploadOffsetHeader, strconv.Itoa(len(s.data)))
+		if int64(len(s.data)) == s.length {
+			s.writeRecord(w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *resumableStub) writeRecord(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(UploadRecord{ID: "1", FileName: "video-1.mp4", Size: s.length})
+}
+
+func Test_UploadFileActivity_Resumable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "merged.mp4")
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	assert.NoError(t, ioutil.WriteFile(fileName, contents, 0644))
+
+	// a previous attempt created the upload and stored the first 45 bytes before failing
+	stub := &resumableStub{length: int64(len(contents)), data: append([]byte{}, contents[:45]...), tokenSecret: "secret"}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{
+		ResumableUploadEndpoint: server.URL + "/uploads",
+		UploadChunkSize:         30,
+		UploadCredentials:       UploadCredentials{TokenSecret: "secret"},
+	}
+	env.RegisterActivity(a)
+	env.SetHeartbeatDetails(UploadProgress{UploadURL: server.URL + "/uploads/1", Offset: 30})
+
+	val, err := env.ExecuteActivity(a.UploadFileActivity, fileName, UploadParams{DeviceID: "deviceId"})
+	assert.NoError(t, err)
+	assert.Equal(t, contents, stub.data)
+	assert.Equal(t, []int64{45, 75}, stub.patches)
+
+	var result UploadResult
+	assert.NoError(t, val.Get(&result))
+	assert.Equal(t, "1", result.ID)
+}
+
+func Test_UploadFileActivity_ResumableAlreadyStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "merged.mp4")
+	assert.NoError(t, ioutil.WriteFile(fileName, bytes.Repeat([]byte("0123456789"), 10), 0644))
+
+	// an earlier attempt completed the upload but timed out before reporting it
+	stub := &resumableStub{length: 100, stored: true}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{ResumableUploadEndpoint: server.URL + "/uploads", UploadChunkSize: 30}
+	env.RegisterActivity(a)
+
+	val, err := env.ExecuteActivity(a.UploadFileActivity, fileName, UploadParams{DeviceID: "deviceId"})
+	assert.NoError(t, err)
+	assert.Empty(t, stub.patches)
+
+	var result UploadResult
+	assert.NoError(t, val.Get(&result))
+	assert.Equal(t, UploadResult{ID: "1", FileName: "video-1.mp4", Size: 100}, result)
+}
+
+func Test_UploadFileActivity_ResumableReceivedNotStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "merged.mp4")
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	assert.NoError(t, ioutil.WriteFile(fileName, contents, 0644))
+
+	// a previous attempt sent every byte, but the server failed to store the upload
+	stub := &resumableStub{length: int64(len(contents)), data: append([]byte{}, contents...)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{ResumableUploadEndpoint: server.URL + "/uploads", UploadChunkSize: 30}
+	env.RegisterActivity(a)
+	env.SetHeartbeatDetails(UploadProgress{UploadURL: server.URL + "/uploads/1", Offset: 100})
+
+	val, err := env.ExecuteActivity(a.UploadFileActivity, fileName, UploadParams{DeviceID: "deviceId"})
+	assert.NoError(t, err)
+	// an empty chunk at the end of the upload stores it
+	assert.Equal(t, []int64{100}, stub.patches)
+	assert.Equal(t, contents, stub.data)
+
+	var result UploadResult
+	assert.NoError(t, val.Get(&result))
+	assert.Equal(t, UploadResult{ID: "1", FileName: "video-1.mp4", Size: 100}, result)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// requestLogSize is how many requests the request log keeps; older entries are dropped
+const requestLogSize = 1000
+
+// requestLogEntry records a request to one of the vendor endpoints
+type requestLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Endpoint   string    `json:"endpoint"`
+	DeviceID   string    `json:"deviceId,omitempty"`
+	// Status is the status answered; zero when the connection was reset without an answer
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	// Fault is the kind of the fault injected into the answer, if any
+	Fault string `json:"fault,omitempty"`
+}
+
+// adminState describes the current behavior of the simulator; its durations are in nanoseconds
+type adminState struct {
+	Seed      int64                     `json:"seed"`
+	Scenarios map[string]Scenario       `json:"scenarios"`
+	Faults    map[string]EndpointFaults `json:"faults"`
+	// AddedMedia lists the media URLs added at runtime per device
+	AddedMedia map[string][]string `json:"addedMedia"`
+}
+
+// decodeAdminBody decodes a request body written in the YAML or JSON syntax of the config file, so that durations
+// are given as strings like "5s"
+func decodeAdminBody(r *http.Request, v interface{}) error {
+	if err := yaml.NewDecoder(r.Body).Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("the request body is empty")
+		}
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// stateHandler handles GET /admin/state
+func (s *vendorServer) stateHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	state := adminState{
+		Seed:       s.seed,
+		Scenarios:  map[string]Scenario{},
+		Faults:     map[string]EndpointFaults{},
+		AddedMedia: map[string][]string{},
+	}
+	for deviceID, player := range s.scenarios {
+		state.Scenarios[deviceID] = player.scenario
+	}
+	for endpoint, faults := range s.faults {
+		state.Faults[endpoint] = faults
+	}
+	for deviceID, links := range s.addedMedia {
+		state.AddedMedia[deviceID] = append([]string{}, links...)
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, state)
+}
+
+// setStatusHandler handles PUT /admin/devices/{deviceId}/status: the device answers the given step, e.g.
+// `{"status": "success"}` or `{"http_status": 503}`, to every request from now on
+func (s *vendorServer) setStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var step ScenarioStep
+	if err := decodeAdminBody(r, &step); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.setScenario(w, mux.Vars(r)["deviceId"], Scenario{Steps: []ScenarioStep{step}})
+}
+
+// setScenarioHandler handles PUT /admin/devices/{deviceId}/scenario, which replaces the scenario of the device
+// with the one in the body and plays it from its first step
+func (s *vendorServer) setScenarioHandler(w http.ResponseWriter, r *http.Request) {
+	var scenario Scenario
+	if err := decodeAdminBody(r, &scenario); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.setScenario(w, mux.Vars(r)["deviceId"], scenario)
+}
+
+func (s *vendorServer) setScenario(w http.ResponseWriter, deviceID string, scenario Scenario) {
+	if err := scenario.validate(deviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.scenarios[deviceID] = &scenarioPlayer{scenario: scenario}
+	// the status of the device changes right away, so that callbacks are notified without waiting for a request
+	if first := scenario.Steps[0]; first.HTTPStatus == 0 {
+		s.recordStatus(deviceID, first.Status)
+	}
+	s.mu.Unlock()
+	fmt.Printf("Set the scenario of device %s\n", deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteScenarioHandler handles DELETE /admin/devices/{deviceId}/scenario: the device gets random statuses again
+func (s *vendorServer) deleteScenarioHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	s.mu.Lock()
+	delete(s.scenarios, deviceID)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setFaultsHandler handles PUT /admin/faults/{endpoint}, which replaces the faults injected into the endpoint
+func (s *vendorServer) setFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	endpoint := mux.Vars(r)["endpoint"]
+	if !isEndpointName(endpoint) {
+		http.Error(w, fmt.Sprintf("unknown endpoint %s", endpoint), http.StatusNotFound)
+		return
+	}
+	var faults EndpointFaults
+	if err := decodeAdminBody(r, &faults); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := faults.validate(endpoint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.faults[endpoint] = faults
+	s.mu.Unlock()
+	fmt.Printf("Set the faults of endpoint %s\n", endpoint)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteFaultsHandler handles DELETE /admin/faults/{endpoint}, which stops injecting faults into the endpoint
+func (s *vendorServer) deleteFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	endpoint := mux.Vars(r)["endpoint"]
+	if !isEndpointName(endpoint) {
+		http.Error(w, fmt.Sprintf("unknown endpoint %s", endpoint), http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	delete(s.faults, endpoint)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetHandler handles POST /admin/reset, which restores the state the simulator started with: the scenarios and
+// faults of the config, played from their start, the random sources reseeded with the startup seed, no media URLs
+// added at runtime, no registered callbacks, no recorded statuses and an empty request log. Media files added at
+// runtime stay in the media directory.
+func (s *vendorServer) resetHandler(w http.ResponseWriter, r *http.Request) {
+	s.reset()
+	fmt.Println("Reset the simulator state")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *vendorServer) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seedSources()
+	s.scenarios = map[string]*scenarioPlayer{}
+	for deviceID, scenario := range s.config.Scenarios {
+		s.scenarios[deviceID] = &scenarioPlayer{scenario: scenario}
+	}
+	s.faults = map[string]EndpointFaults{}
+	for endpoint, faults := range s.config.Faults {
+		s.faults[endpoint] = faults
+	}
+	s.addedMedia = map[string][]string{}
+	s.requests = nil
+	s.statuses = map[string]string{}
+	for id, c := range s.callbacks {
+		if !c.configured {
+			s.removeCallback(id)
+		}
+	}
+}
+
+// requestLogHandler handles GET /admin/requests, the logged requests in the order they were received, optionally
+// filtered with ?deviceId=, ?endpoint= and ?since= (RFC 3339)
+func (s *vendorServer) requestLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			http.Error(w, "since is not an RFC 3339 time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	entries := []requestLogEntry{}
+	for _, entry := range s.requests {
+		if (query.Get("deviceId") != "" && entry.DeviceID != query.Get("deviceId")) ||
+			(query.Get("endpoint") != "" && entry.Endpoint != query.Get("endpoint")) ||
+			entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	s.mu.Unlock()
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// clearRequestLogHandler handles DELETE /admin/requests
+func (s *vendorServer) clearRequestLogHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = nil
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestLogMiddleware logs the requests to the vendor endpoints, the named routes; admin requests are not logged
+func (s *vendorServer) requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || route.GetName() == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entry := requestLogEntry{
+			Time:       time.Now().UTC(),
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Endpoint:   route.GetName(),
+			DeviceID:   mux.Vars(r)["deviceId"],
+		}
+		logged := &loggedResponse{ResponseWriter: w}
+		next.ServeHTTP(logged, r)
+		entry.Status = logged.status
+		if entry.Status == 0 && !logged.hijacked {
+			entry.Status = http.StatusOK
+		}
+		entry.DurationMs = float64(time.Since(entry.Time)) / float64(time.Millisecond)
+		entry.Fault = logged.fault
+
+		s.mu.Lock()
+		s.requests = append(s.requests, entry)
+		if len(s.requests) > requestLogSize {
+			s.requests = s.requests[len(s.requests)-requestLogSize:]
+		}
+		s.mu.Unlock()
+	})
+}
+
+// loggedResponse captures the status of an answer for the request log; the fault middleware notes the injected fault
+type loggedResponse struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+	fault    string
+}
+
+func (l *loggedResponse) WriteHeader(status int) {
+	if l.status == 0 {
+		l.status = status
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *loggedResponse) Write(b []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+func (l *loggedResponse) Flush() {
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (l *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	l.hijacked = true
+	return hijacker.Hijack()
+}
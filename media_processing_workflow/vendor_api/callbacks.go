@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// callbackQueueSize is how many notifications may wait for delivery to a single callback
+	callbackQueueSize = 100
+	// maxCallbackRetryInterval caps the doubling interval between delivery attempts
+	maxCallbackRetryInterval = time.Minute
+)
+
+// CallbacksConfig configures the callbacks notified when the media status of a device changes from pending
+type CallbacksConfig struct {
+	// URLs are notified from startup on, in addition to the callbacks registered with POST /callbacks
+	URLs          []CallbackConfig `yaml:"urls"`
+	MaxAttempts   int              `yaml:"max_attempts"`
+	RetryInterval time.Duration    `yaml:"retry_interval"`
+	Timeout       time.Duration    `yaml:"timeout"`
+}
+
+// CallbackConfig is a callback URL, notified of the changes of a single device when DeviceID is set. Notifications
+// to a callback with a secret carry the HMAC-SHA256 signature of their timestamp and body.
+type CallbackConfig struct {
+	URL      string `yaml:"url" json:"url"`
+	Secret   string `yaml:"secret" json:"secret,omitempty"`
+	DeviceID string `yaml:"device_id" json:"deviceId,omitempty"`
+}
+
+func (c CallbackConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback url %q is not an http(s) URL", c.URL)
+	}
+	return nil
+}
+
+// callbackRegistration describes a callback in the answers of the callback endpoints; the secret is not disclosed
+type callbackRegistration struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	DeviceID string `json:"deviceId,omitempty"`
+	// Configured callbacks come from the config file and cannot be unregistered
+	Configured bool `json:"configured"`
+}
+
+// callback delivers the notifications to a single URL in order
+type callback struct {
+	id         string
+	config     CallbackConfig
+	configured bool
+	sender     *media_processing_workflow.WebhookSender
+	queue      chan media_processing_workflow.MediaStatusChange
+}
+
+func (c *callback) registration() callbackRegistration {
+	return callbackRegistration{ID: c.id, URL: c.config.URL, DeviceID: c.config.DeviceID, Configured: c.configured}
+}
+
+// addCallback starts delivering notifications to the callback; the caller holds s.mu
+func (s *vendorServer) addCallback(config CallbackConfig, configured bool) *callback {
+	c := &callback{
+		id:         uuid.New(),
+		config:     config,
+		configured: configured,
+		sender: &media_processing_workflow.WebhookSender{
+			URL:              config.URL,
+			Secret:           config.Secret,
+			Client:           &http.Client{Timeout: s.config.Callbacks.Timeout},
+			MaxAttempts:      s.config.Callbacks.MaxAttempts,
+			RetryInterval:    s.config.Callbacks.RetryInterval,
+			MaxRetryInterval: maxCallbackRetryInterval,
+			OnRetry: func(id string, attempt int, wait time.Duration, err error) {
+				fmt.Printf("Notifying callback %s of %s failed, retrying in %s: %v\n", config.URL, id, wait, err)
+			},
+		},
+		queue: make(chan media_processing_workflow.MediaStatusChange, callbackQueueSize),
+	}
+	s.callbacks[c.id] = c
+	go c.run()
+	return c
+}
+
+// removeCallback stops the callback once the notifications already queued are delivered; the caller holds s.mu
+func (s *vendorServer) removeCallback(id string) {
+	if c, ok := s.callbacks[id]; ok {
+		delete(s.callbacks, id)
+		close(c.queue)
+	}
+}
+
+// recordStatus notes the media status of the device and notifies the callbacks when it changes from pending to
+// success or not_obtainable; the caller holds s.mu
+func (s *vendorServer) recordStatus(deviceID string, status string) {
+	previous := s.statuses[deviceID]
+	s.statuses[deviceID] = status
+	if previous != media_processing_workflow.Pending || status == media_processing_workflow.Pending {
+		return
+	}
+
+	change := media_processing_workflow.MediaStatusChange{
+		ID:             uuid.New(),
+		Type:           media_processing_workflow.MediaStatusChangedEvent,
+		CreatedAt:      time.Now().UTC(),
+		DeviceId:       deviceID,
+		PreviousStatus: previous,
+		Status:         status,
+	}
+	fmt.Printf("Media status of device %s changed from %s to %s\n", deviceID, previous, status)
+	for _, c := range s.callbacks {
+		if c.config.DeviceID != "" && c.config.DeviceID != deviceID {
+			continue
+		}
+		select {
+		case c.queue <- change:
+		default:
+			fmt.Printf("Dropped notification %s for callback %s: its queue is full\n", change.ID, c.config.URL)
+		}
+	}
+}
+
+func (c *callback) run() {
+	for change := range c.queue {
+		c.deliver(change)
+	}
+}
+
+func (c *callback) deliver(change media_processing_workflow.MediaStatusChange) {
+	body, err := json.Marshal(change)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := c.sender.Deliver(context.Background(), change.ID, body); err != nil {
+		fmt.Printf("Giving up on notification %s for callback %s: %v\n", change.ID, c.config.URL, err)
+	}
+}
+
+// registerCallbackHandler handles POST /callbacks, which registers a callback from a JSON body
+// `{"url": ..., "secret": ..., "deviceId": ...}`; secret and deviceId are optional
+func (s *vendorServer) registerCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	var config CallbackConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := config.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	c := s.addCallback(config, false)
+	s.mu.Unlock()
+	fmt.Printf("Registered callback %s for %s\n", c.id, config.URL)
+	w.Header().Set("Location", "/callbacks/"+c.id)
+	writeJSON(w, http.StatusCreated, c.registration())
+}
+
+// callbacksHandler handles GET /callbacks, which lists the callbacks
+func (s *vendorServer) callbacksHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	registrations := []callbackRegistration{}
+	for _, c := range s.callbacks {
+		registrations = append(registrations, c.registration())
+	}
+	s.mu.Unlock()
+	sort.Slice(registrations, func(i, j int) bool { return registrations[i].URL < registrations[j].URL })
+	writeJSON(w, http.StatusOK, registrations)
+}
+
+// unregisterCallbackHandler handles DELETE /callbacks/{id}
+func (s *vendorServer) unregisterCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.callbacks[id]
+	switch {
+	case !ok:
+		http.Error(w, fmt.Sprintf("unknown callback %s", id), http.StatusNotFound)
+	case c.configured:
+		http.Error(w, fmt.Sprintf("callback %s is configured in the config file", id), http.StatusConflict)
+	default:
+		s.removeCallback(id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// callbackReceiver records the notifications posted to it, answering the first failures requests with 503
+type callbackReceiver struct {
+	*httptest.Server
+	mu            sync.Mutex
+	failures      int
+	attempts      int
+	notifications chan media_processing_workflow.MediaStatusChange
+}
+
+func newCallbackReceiver(t *testing.T, secret string, failures int) *callbackReceiver {
+	c := &callbackReceiver{failures: failures, notifications: make(chan media_processing_workflow.MediaStatusChange, 10)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if secret != "" {
+			assert.NoError(t, media_processing_workflow.VerifyPayloadSignature([]byte(secret), body,
+				r.Header.Get(media_processing_workflow.WebhookTimestampHeader), r.Header.Get(media_processing_workflow.WebhookSignatureHeader),
+				time.Now(), media_processing_workflow.DefaultWebhookTolerance))
+		}
+		c.mu.Lock()
+		c.attempts++
+		failed := c.attempts <= c.failures
+		c.mu.Unlock()
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var change media_processing_workflow.MediaStatusChange
+		assert.NoError(t, json.Unmarshal(body, &change))
+		assert.Equal(t, change.ID, r.Header.Get(media_processing_workflow.WebhookIDHeader))
+		c.notifications <- change
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// next waits for the next notification
+func (c *callbackReceiver) next(t *testing.T) media_processing_workflow.MediaStatusChange {
+	select {
+	case change := <-c.notifications:
+		return change
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no notification received")
+		return media_processing_workflow.MediaStatusChange{}
+	}
+}
+
+func (c *callbackReceiver) assertNoNotification(t *testing.T) {
+	select {
+	case change := <-c.notifications:
+		assert.Failf(t, "unexpected notification", "%+v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func adminPut(t *testing.T, serverURL string, path string, body string) {
+	req, err := http.NewRequest(http.MethodPut, serverURL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func Test_Callbacks_AdminStatus(t *testing.T) {
+	receiver := newCallbackReceiver(t, "secret", 1)
+	other := newCallbackReceiver(t, "", 0)
+	config := newTestConfig()
+	config.Callbacks.URLs = []CallbackConfig{{URL: other.URL, DeviceID: "device-2"}}
+	server := httptest.NewServer(newVendorServer(config, 1).router())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/callbacks", "application/json",
+		strings.NewReader(`{"url": "`+receiver.URL+`", "secret": "secret", "deviceId": "device-1"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// the admin api drives the transitions of a device without any request to /mediastatus; the first delivery is
+	// answered 503 and retried
+	adminPut(t, server.URL, "/admin/devices/device-1/status", `{"status": "pending"}`)
+	adminPut(t, server.URL, "/admin/devices/device-1/status", `{"status": "success"}`)
+	change := receiver.next(t)
+	assert.Equal(t, media_processing_workflow.MediaStatusChangedEvent, change.Type)
+	assert.Equal(t, "device-1", change.DeviceId)
+	assert.Equal(t, media_processing_workflow.Pending, change.PreviousStatus)
+	assert.Equal(t, media_processing_workflow.Success, change.Status)
+	receiver.mu.Lock()
+	assert.Equal(t, 2, receiver.attempts)
+	receiver.mu.Unlock()
+
+	// only changes from pending are notified
+	adminPut(t, server.URL, "/admin/devices/device-1/status", `{"status": "not_obtainable"}`)
+	receiver.assertNoNotification(t)
+	other.assertNoNotification(t)
+}
+
+func Test_Callbacks_PolledScenario(t *testing.T) {
+	receiver := newCallbackReceiver(t, "", 0)
+	config := newTestConfig()
+	config.Callbacks.URLs = []CallbackConfig{{URL: receiver.URL}}
+	config.Scenarios = map[string]Scenario{"device-1": {Steps: []ScenarioStep{
+		{Status: media_processing_workflow.Pending, Repeat: 2},
+		{Status: media_processing_workflow.Success},
+	}}}
+	server := httptest.NewServer(newVendorServer(config, 1).router())
+	defer server.Close()
+
+	poll := func() {
+		resp, err := http.Get(server.URL + "/mediastatus/device-1")
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	poll()
+	poll()
+	receiver.assertNoNotification(t)
+	poll()
+	change := receiver.next(t)
+	assert.Equal(t, media_processing_workflow.Pending, change.PreviousStatus)
+	assert.Equal(t, media_processing_workflow.Success, change.Status)
+}
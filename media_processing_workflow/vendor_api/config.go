@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,6 +18,16 @@ type VendorConfig struct {
 			MediaURLs               []string `yaml:"media_urls"`
 		} `yaml:"options"`
 	} `yaml:"server"`
+	// Devices lists the known devices and their media; devices with a directory in the media dir are known too
+	Devices map[string]DeviceConfig `yaml:"devices"`
+	// Scenarios script the media status of devices; the other devices get a random status
+	Scenarios map[string]Scenario `yaml:"scenarios"`
+	// Faults inject latency and failures into the answers of the endpoints, keyed by endpoint name
+	Faults map[string]EndpointFaults `yaml:"faults"`
+	// Media serves local media files; they are offered by /mediaurls unless media_urls are configured
+	Media MediaConfig `yaml:"media"`
+	// Callbacks are notified when the media status of a device changes from pending
+	Callbacks CallbacksConfig `yaml:"callbacks"`
 }
 
 // NewVendorConfig returns a struct composed of vendor config info
@@ -34,6 +46,39 @@ func NewVendorConfig(configPath string) (*VendorConfig, error) {
 	if err := d.Decode(&config); err != nil {
 		return nil, err
 	}
+	for deviceID, scenario := range config.Scenarios {
+		if err := scenario.validate(deviceID); err != nil {
+			return nil, err
+		}
+	}
+	if config.Media.Generate.Duration <= 0 {
+		config.Media.Generate.Duration = 5 * time.Second
+	}
+	if config.Media.Generate.Size == "" {
+		config.Media.Generate.Size = "1280x720"
+	}
+	if config.Callbacks.MaxAttempts <= 0 {
+		config.Callbacks.MaxAttempts = 5
+	}
+	if config.Callbacks.RetryInterval <= 0 {
+		config.Callbacks.RetryInterval = time.Second
+	}
+	if config.Callbacks.Timeout <= 0 {
+		config.Callbacks.Timeout = 10 * time.Second
+	}
+	for _, callback := range config.Callbacks.URLs {
+		if err := callback.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for endpoint, faults := range config.Faults {
+		if !isEndpointName(endpoint) {
+			return nil, fmt.Errorf("faults are configured for unknown endpoint %q", endpoint)
+		}
+		if err := faults.validate(endpoint); err != nil {
+			return nil, err
+		}
+	}
 
 	return config, nil
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// maxAddedMediaSize caps the size of a media file added through the admin endpoint
+const maxAddedMediaSize = 1 << 30
+
+// DeviceConfig configures the media of a device
+type DeviceConfig struct {
+	// MediaURLs are returned by /mediaurls for the device, along with the files of its media directory
+	MediaURLs []string `yaml:"media_urls"`
+}
+
+// addMediaRequest is the JSON body of POST /admin/devices/{deviceId}/media adding media URLs to a device
+type addMediaRequest struct {
+	URLs []string `json:"urls"`
+}
+
+// deviceDirs returns the devices with their own subdirectory of the media directory
+func (s *vendorServer) deviceDirs() ([]string, error) {
+	if s.config.Media.Dir == "" {
+		return nil, nil
+	}
+	infos, err := ioutil.ReadDir(s.config.Media.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	devices := []string{}
+	for _, info := range infos {
+		if info.IsDir() && isMediaFileName(info.Name()) {
+			devices = append(devices, info.Name())
+		}
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// knownDevice reports whether the simulator knows the device: it is configured in devices, has a scenario, a media
+// directory or media added at runtime. When neither devices nor device directories exist, every device is known and
+// shares the configured media; media URLs or scenarios added at runtime only make their own device known.
+func (s *vendorServer) knownDevice(deviceID string) (bool, error) {
+	dirs, err := s.deviceDirs()
+	if err != nil {
+		return false, err
+	}
+
+	if len(s.config.Devices) == 0 && len(dirs) == 0 {
+		return true, nil
+	}
+
+	s.mu.Lock()
+	_, added := s.addedMedia[deviceID]
+	_, scripted := s.scenarios[deviceID]
+	s.mu.Unlock()
+	_, configured := s.config.Devices[deviceID]
+	for _, dir := range dirs {
+		if dir == deviceID {
+			return true, nil
+		}
+	}
+	return configured || scripted || added, nil
+}
+
+// deviceMediaURLs returns the media URLs of a known device: its configured URLs, the files of its media directory
+// and the URLs added at runtime. A device without media of its own gets the shared media_urls, or the shared local
+// media files when those are empty.
+func (s *vendorServer) deviceMediaURLs(deviceID string) ([]string, error) {
+	links := append([]string{}, s.config.Devices[deviceID].MediaURLs...)
+	if s.config.Media.Dir != "" && isMediaFileName(deviceID) {
+		local, err := s.localMediaURLs(deviceID)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		links = append(links, local...)
+	}
+	s.mu.Lock()
+	links = append(links, s.addedMedia[deviceID]...)
+	s.mu.Unlock()
+	if len(links) > 0 {
+		return links, nil
+	}
+
+	links = s.config.Server.Options.MediaURLs
+	// without configured URLs, the shared local media files are offered
+	if len(links) == 0 && s.config.Media.Dir != "" {
+		return s.localMediaURLs("")
+	}
+	return links, nil
+}
+
+// addMediaHandler handles POST /admin/devices/{deviceId}/media, which simulates new recordings of a device.
+// A JSON body `{"urls": [...]}` adds media URLs; any other body is stored as a media file named by the `name` query
+// parameter in the media directory of the device. The answer lists the media URLs of the device.
+func (s *vendorServer) addMediaHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+
+	var added []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req addMediaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.URLs) == 0 {
+			http.Error(w, "no urls to add", http.StatusBadRequest)
+			return
+		}
+		for _, link := range req.URLs {
+			if u, err := url.Parse(link); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				http.Error(w, fmt.Sprintf("%q is not an http(s) URL", link), http.StatusBadRequest)
+				return
+			}
+		}
+		added = req.URLs
+	} else {
+		name := r.URL.Query().Get("name")
+		switch {
+		case s.config.Media.Dir == "":
+			http.Error(w, "media files cannot be added: no media dir is configured", http.StatusConflict)
+			return
+		case !isMediaFileName(deviceID):
+			http.Error(w, fmt.Sprintf("device %q cannot have a media directory", deviceID), http.StatusBadRequest)
+			return
+		case !isMediaFileName(name):
+			http.Error(w, "the name query parameter must be a plain file name", http.StatusBadRequest)
+			return
+		}
+		if err := s.storeMediaFile(deviceID, name, http.MaxBytesReader(w, r.Body, maxAddedMediaSize)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.addedMedia[deviceID] = append(s.addedMedia[deviceID], added...)
+	s.mu.Unlock()
+	fmt.Printf("Added media to device %s\n", deviceID)
+
+	links, err := s.deviceMediaURLs(deviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(media_processing_workflow.MediaURLs{DeviceId: deviceID, Links: links})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// storeMediaFile writes a media file into the media directory of the device, under a temporary name first so that
+// a partial file is never served
+func (s *vendorServer) storeMediaFile(deviceID string, name string, body io.Reader) error {
+	dir := filepath.Join(s.config.Media.Dir, deviceID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
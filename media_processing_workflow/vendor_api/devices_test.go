@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getStatus(t *testing.T, serverURL string, path string) int {
+	resp, err := http.Get(serverURL + path)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func Test_KnownDevice_WithoutDevices(t *testing.T) {
+	server := httptest.NewServer(newVendorServer(newTestConfig(), 1).router())
+	defer server.Close()
+	assert.Equal(t, http.StatusOK, getStatus(t, server.URL, "/mediaurls/device-1"))
+
+	// media added to one device at runtime does not make the others unknown
+	resp, err := http.Post(server.URL+"/admin/devices/device-1/media", "application/json", strings.NewReader(`{"urls": ["https://example.com/clip.mp4"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, http.StatusOK, getStatus(t, server.URL, "/mediaurls/device-2"))
+	assert.Equal(t, http.StatusOK, getStatus(t, server.URL, "/mediastatus/device-2"))
+}
+
+func Test_KnownDevice_WithDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendormedia")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "camera-2"), 0755))
+
+	config := newTestConfig()
+	config.Media.Dir = dir
+	config.Devices = map[string]DeviceConfig{"camera-1": {MediaURLs: []string{"https://example.com/camera-1.mp4"}}}
+	config.Scenarios = map[string]Scenario{"camera-3": {Steps: []ScenarioStep{{Status: "success"}}}}
+	server := httptest.NewServer(newVendorServer(config, 1).router())
+	defer server.Close()
+
+	for _, device := range []string{"camera-1", "camera-2", "camera-3"} {
+		assert.Equal(t, http.StatusOK, getStatus(t, server.URL, "/mediastatus/"+device), device)
+	}
+	assert.Equal(t, http.StatusNotFound, getStatus(t, server.URL, "/mediastatus/camera-4"))
+	assert.Equal(t, http.StatusNotFound, getStatus(t, server.URL, "/mediaurls/camera-4"))
+
+	resp, err := http.Post(server.URL+"/admin/devices/camera-4/media", "application/json", strings.NewReader(`{"urls": ["https://example.com/camera-4.mp4"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, getStatus(t, server.URL, "/mediaurls/camera-4"))
+	assert.Equal(t, http.StatusNotFound, getStatus(t, server.URL, "/mediaurls/camera-5"))
+}
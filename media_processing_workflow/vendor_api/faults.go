@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// latency distributions
+const (
+	LatencyFixed       = "fixed"
+	LatencyUniform     = "uniform"
+	LatencyNormal      = "normal"
+	LatencyExponential = "exponential"
+)
+
+// fault kinds
+const (
+	// FaultError answers with an error status, with a Retry-After header when configured
+	FaultError = "error"
+	// FaultTruncate declares the full Content-Length but closes the connection halfway through the body; json
+	// endpoints only
+	FaultTruncate = "truncate"
+	// FaultMalformedJSON answers 200 with a body that is not valid json; json endpoints only
+	FaultMalformedJSON = "malformed_json"
+	// FaultReset resets the connection without answering
+	FaultReset = "reset"
+	// FaultStall stops sending the body for a while after some bytes, as a stalled download does
+	FaultStall = "stall"
+)
+
+// EndpointFaults configures the faults injected into the answers of an endpoint
+type EndpointFaults struct {
+	Latency LatencyConfig `yaml:"latency" json:"latency,omitempty"`
+	// Faults are drawn independently per request; at most one fault is injected, so the probabilities of the
+	// faults of an endpoint add up to at most 1
+	Faults []FaultConfig `yaml:"faults" json:"faults,omitempty"`
+}
+
+// LatencyConfig delays every answer of an endpoint by a duration drawn from a distribution:
+// fixed (mean), uniform (min to max), normal (mean and stddev) or exponential (mean). Durations are capped at max
+// when it is set.
+type LatencyConfig struct {
+	Distribution string        `yaml:"distribution" json:"distribution,omitempty"`
+	Min          time.Duration `yaml:"min" json:"min,omitempty"`
+	Max          time.Duration `yaml:"max" json:"max,omitempty"`
+	Mean         time.Duration `yaml:"mean" json:"mean,omitempty"`
+	StdDev       time.Duration `yaml:"stddev" json:"stddev,omitempty"`
+}
+
+// FaultConfig is a fault injected with the given probability
+type FaultConfig struct {
+	Kind        string  `yaml:"kind" json:"kind,omitempty"`
+	Probability float64 `yaml:"probability" json:"probability,omitempty"`
+	// Status and RetryAfter configure error faults, e.g. 429, 500 or 503
+	Status     int           `yaml:"status" json:"status,omitempty"`
+	RetryAfter time.Duration `yaml:"retry_after" json:"retry_after,omitempty"`
+	// AfterBytes and Duration configure stall faults
+	AfterBytes int64         `yaml:"after_bytes" json:"after_bytes,omitempty"`
+	Duration   time.Duration `yaml:"duration" json:"duration,omitempty"`
+}
+
+func (e EndpointFaults) validate(endpoint string) error {
+	switch e.Latency.Distribution {
+	case "", LatencyFixed, LatencyUniform, LatencyNormal, LatencyExponential:
+	default:
+		return fmt.Errorf("faults of %q have unknown latency distribution %q", endpoint, e.Latency.Distribution)
+	}
+	if e.Latency.Distribution == LatencyUniform && e.Latency.Max < e.Latency.Min {
+		return fmt.Errorf("faults of %q have a uniform latency with max below min", endpoint)
+	}
+
+	total := 0.0
+	for i, fault := range e.Faults {
+		if fault.Probability < 0 || fault.Probability > 1 {
+			return fmt.Errorf("fault %d of %q has probability %v outside of [0, 1]", i+1, endpoint, fault.Probability)
+		}
+		total += fault.Probability
+		switch fault.Kind {
+		case FaultError:
+			if fault.Status < 400 || fault.Status > 599 {
+				return fmt.Errorf("error fault %d of %q has status %d, which is not an error status", i+1, endpoint, fault.Status)
+			}
+		case FaultStall:
+			if fault.Duration <= 0 {
+				return fmt.Errorf("stall fault %d of %q needs a duration", i+1, endpoint)
+			}
+		case FaultTruncate, FaultMalformedJSON:
+			// the answer is buffered to inject these faults, which is only reasonable for the small json answers
+			if !isJSONEndpoint(endpoint) {
+				return fmt.Errorf("%s fault %d of %q is only supported by the json endpoints %s and %s", fault.Kind, i+1, endpoint, endpointMediaStatus, endpointMediaURLs)
+			}
+		case FaultReset:
+		default:
+			return fmt.Errorf("fault %d of %q has unknown kind %q", i+1, endpoint, fault.Kind)
+		}
+	}
+	if total > 1 {
+		return fmt.Errorf("the fault probabilities of %q add up to more than 1", endpoint)
+	}
+	return nil
+}
+
+// drawFaults draws the latency and the fault, if any, injected into a request to the endpoint
+func (s *vendorServer) drawFaults(endpoint string) (time.Duration, *FaultConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, ok := s.faults[endpoint]
+	if !ok {
+		return 0, nil
+	}
+	latency := s.drawLatency(config.Latency)
+	draw := s.faultRand.Float64()
+	for i := range config.Faults {
+		if draw < config.Faults[i].Probability {
+			fault := config.Faults[i]
+			return latency, &fault
+		}
+		draw -= config.Faults[i].Probability
+	}
+	return latency, nil
+}
+
+// drawLatency draws a duration from the latency distribution; the caller holds s.mu
+func (s *vendorServer) drawLatency(config LatencyConfig) time.Duration {
+	var latency float64
+	switch config.Distribution {
+	case LatencyFixed:
+		latency = float64(config.Mean)
+	case LatencyUniform:
+		latency = float64(config.Min) + s.faultRand.Float64()*float64(config.Max-config.Min)
+	case LatencyNormal:
+		latency = float64(config.Mean) + s.faultRand.NormFloat64()*float64(config.StdDev)
+	case LatencyExponential:
+		latency = s.faultRand.ExpFloat64() * float64(config.Mean)
+	}
+	latency = math.Max(latency, float64(config.Min))
+	if config.Max > 0 {
+		latency = math.Min(latency, float64(config.Max))
+	}
+	return time.Duration(latency)
+}
+
+// faultMiddleware injects the latency and faults configured for the endpoint, the name of the matched route
+func (s *vendorServer) faultMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		endpoint := route.GetName()
+		latency, fault := s.drawFaults(endpoint)
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fmt.Printf("Injecting %s fault into %s %s\n", fault.Kind, r.Method, r.URL.Path)
+		if logged, ok := w.(*loggedResponse); ok {
+			logged.fault = fault.Kind
+		}
+		switch fault.Kind {
+		case FaultError:
+			if fault.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(fault.RetryAfter.Seconds()))))
+			}
+			http.Error(w, fmt.Sprintf("injected %d fault", fault.Status), fault.Status)
+		case FaultReset:
+			resetConnection(w)
+		case FaultTruncate:
+			rec := newResponseRecorder()
+			next.ServeHTTP(rec, r)
+			body := rec.body.Bytes()
+			copyHeader(w.Header(), rec.header)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(rec.status)
+			w.Write(body[:len(body)/2])
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			// closing the connection short of the declared length
+			closeConnection(w)
+		case FaultMalformedJSON:
+			rec := newResponseRecorder()
+			next.ServeHTTP(rec, r)
+			body := rec.body.Bytes()
+			// the json is never closed, so the body does not parse wherever it is cut, even within a string
+			malformed := append(append([]byte{}, body[:len(body)/2]...), []byte(`,"`)...)
+			copyHeader(w.Header(), rec.header)
+			w.Header().Set("Content-Length", strconv.Itoa(len(malformed)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(malformed)
+		case FaultStall:
+			next.ServeHTTP(&stallingWriter{ResponseWriter: w, request: r, afterBytes: fault.AfterBytes, duration: fault.Duration}, r)
+		}
+	})
+}
+
+// resetConnection aborts the connection of the request with a TCP reset instead of an answer
+func resetConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection reset not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		// discarding the unsent data on close sends a reset instead of a regular close
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// closeConnection closes the connection of the request after the data written so far
+func closeConnection(w http.ResponseWriter) {
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for name, values := range src {
+		dst[name] = values
+	}
+}
+
+// responseRecorder captures an answer so that a fault can be injected into it
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}, status: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+// stallingWriter stops writing the body for the duration once afterBytes have been written
+type stallingWriter struct {
+	http.ResponseWriter
+	request    *http.Request
+	afterBytes int64
+	duration   time.Duration
+	written    int64
+	stalled    bool
+}
+
+func (s *stallingWriter) Write(b []byte) (int, error) {
+	if s.stalled || s.written+int64(len(b)) <= s.afterBytes {
+		n, err := s.ResponseWriter.Write(b)
+		s.written += int64(n)
+		return n, err
+	}
+
+	head := b[:s.afterBytes-s.written]
+	n, err := s.ResponseWriter.Write(head)
+	s.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	s.stalled = true
+	select {
+	case <-time.After(s.duration):
+	case <-s.request.Context().Done():
+		return n, s.request.Context().Err()
+	}
+	m, err := s.ResponseWriter.Write(b[len(head):])
+	s.written += int64(m)
+	return n + m, err
+}
+
+func (s *stallingWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFaultyServer serves a simulator injecting the fault into every answer of the mediastatus endpoint
+func newFaultyServer(t *testing.T, fault FaultConfig) *httptest.Server {
+	config := newTestConfig()
+	config.Faults = map[string]EndpointFaults{endpointMediaStatus: {Faults: []FaultConfig{fault}}}
+	require.NoError(t, config.Faults[endpointMediaStatus].validate(endpointMediaStatus))
+	server := httptest.NewServer(newVendorServer(config, 1).router())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func Test_Faults_Error(t *testing.T) {
+	server := newFaultyServer(t, FaultConfig{Kind: FaultError, Probability: 1, Status: 503, RetryAfter: 1500 * time.Millisecond})
+
+	resp, err := http.Get(server.URL + "/mediastatus/device-1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// endpoints without faults answer normally
+	resp, err = http.Get(server.URL + "/mediaurls/device-1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_Faults_Reset(t *testing.T) {
+	server := newFaultyServer(t, FaultConfig{Kind: FaultReset, Probability: 1})
+
+	_, err := http.Get(server.URL + "/mediastatus/device-1")
+	assert.Error(t, err)
+}
+
+func Test_Faults_Truncate(t *testing.T) {
+	server := newFaultyServer(t, FaultConfig{Kind: FaultTruncate, Probability: 1})
+
+	resp, err := http.Get(server.URL + "/mediastatus/device-1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Error(t, err)
+	assert.Equal(t, resp.ContentLength/2, int64(len(body)))
+}
+
+func Test_Faults_MalformedJSON(t *testing.T) {
+	server := newFaultyServer(t, FaultConfig{Kind: FaultMalformedJSON, Probability: 1})
+
+	resp, err := http.Get(server.URL + "/mediastatus/device-1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var status media_processing_workflow.MediaStatus
+	assert.Error(t, json.NewDecoder(resp.Body).Decode(&status))
+}
+
+func Test_Faults_Stall(t *testing.T) {
+	server := newFaultyServer(t, FaultConfig{Kind: FaultStall, Probability: 1, AfterBytes: 5, Duration: 200 * time.Millisecond})
+
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/mediastatus/device-1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var status media_processing_workflow.MediaStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, "device-1", status.DeviceId)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
+
+func Test_DrawLatency(t *testing.T) {
+	s := newVendorServer(newTestConfig(), 1)
+	draw := func(config LatencyConfig, n int) []time.Duration {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		latencies := make([]time.Duration, n)
+		for i := range latencies {
+			latencies[i] = s.drawLatency(config)
+		}
+		return latencies
+	}
+	mean := func(latencies []time.Duration) time.Duration {
+		var total time.Duration
+		for _, latency := range latencies {
+			total += latency
+		}
+		return total / time.Duration(len(latencies))
+	}
+
+	assert.Equal(t, []time.Duration{50 * time.Millisecond, 50 * time.Millisecond},
+		draw(LatencyConfig{Distribution: LatencyFixed, Mean: 50 * time.Millisecond}, 2))
+	assert.Equal(t, []time.Duration{0}, draw(LatencyConfig{}, 1))
+
+	uniform := draw(LatencyConfig{Distribution: LatencyUniform, Min: 10 * time.Millisecond, Max: 20 * time.Millisecond}, 1000)
+	for _, latency := range uniform {
+		assert.True(t, latency >= 10*time.Millisecond && latency <= 20*time.Millisecond, latency)
+	}
+	assert.InDelta(t, float64(15*time.Millisecond), float64(mean(uniform)), float64(time.Millisecond))
+
+	normal := draw(LatencyConfig{Distribution: LatencyNormal, Mean: 100 * time.Millisecond, StdDev: 50 * time.Millisecond, Max: 150 * time.Millisecond}, 1000)
+	for _, latency := range normal {
+		// negative draws are clamped to min and long ones capped at max
+		assert.True(t, latency >= 0 && latency <= 150*time.Millisecond, latency)
+	}
+
+	exponential := draw(LatencyConfig{Distribution: LatencyExponential, Mean: 100 * time.Millisecond}, 5000)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(mean(exponential)), float64(10*time.Millisecond))
+}
+
+func Test_EndpointFaults_Validate(t *testing.T) {
+	for _, test := range []struct {
+		endpoint string
+		faults   EndpointFaults
+		err      string
+	}{
+		{endpointMediaStatus, EndpointFaults{Latency: LatencyConfig{Distribution: LatencyNormal}, Faults: []FaultConfig{
+			{Kind: FaultTruncate, Probability: 0.5}, {Kind: FaultMalformedJSON, Probability: 0.5},
+		}}, ""},
+		{endpointMedia, EndpointFaults{Faults: []FaultConfig{
+			{Kind: FaultStall, Probability: 0.5, Duration: time.Second}, {Kind: FaultReset, Probability: 0.5},
+		}}, ""},
+		{endpointMedia, EndpointFaults{Faults: []FaultConfig{{Kind: FaultTruncate, Probability: 0.1}}},
+			`truncate fault 1 of "media" is only supported by the json endpoints mediastatus and mediaurls`},
+		{endpointMedia, EndpointFaults{Faults: []FaultConfig{{Kind: FaultMalformedJSON, Probability: 0.1}}},
+			`malformed_json fault 1 of "media" is only supported by the json endpoints mediastatus and mediaurls`},
+		{endpointMediaURLs, EndpointFaults{Latency: LatencyConfig{Distribution: "pareto"}},
+			`faults of "mediaurls" have unknown latency distribution "pareto"`},
+		{endpointMediaURLs, EndpointFaults{Latency: LatencyConfig{Distribution: LatencyUniform, Min: time.Second}},
+			`faults of "mediaurls" have a uniform latency with max below min`},
+		{endpointMediaURLs, EndpointFaults{Faults: []FaultConfig{{Kind: FaultError, Probability: 0.1, Status: 302}}},
+			`error fault 1 of "mediaurls" has status 302, which is not an error status`},
+		{endpointMediaURLs, EndpointFaults{Faults: []FaultConfig{{Kind: FaultStall, Probability: 0.1}}},
+			`stall fault 1 of "mediaurls" needs a duration`},
+		{endpointMediaURLs, EndpointFaults{Faults: []FaultConfig{{Kind: FaultReset, Probability: 1.5}}},
+			`fault 1 of "mediaurls" has probability 1.5 outside of [0, 1]`},
+		{endpointMediaURLs, EndpointFaults{Faults: []FaultConfig{{Kind: FaultReset, Probability: 0.6}, {Kind: FaultReset, Probability: 0.6}}},
+			`the fault probabilities of "mediaurls" add up to more than 1`},
+		{endpointMediaURLs, EndpointFaults{Faults: []FaultConfig{{Kind: "teapot", Probability: 0.1}}},
+			`fault 1 of "mediaurls" has unknown kind "teapot"`},
+	} {
+		err := test.faults.validate(test.endpoint)
+		if test.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, test.err)
+		}
+	}
+}
+
+func Test_SetFaultsHandler(t *testing.T) {
+	server := httptest.NewServer(newVendorServer(newTestConfig(), 1).router())
+	defer server.Close()
+
+	put := func(endpoint string, body string) int {
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/admin/faults/"+endpoint, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, put(endpointMedia, `{"faults": [{"kind": "truncate", "probability": 1}]}`))
+	assert.Equal(t, http.StatusNotFound, put("uploads", `{}`))
+	assert.Equal(t, http.StatusNoContent, put(endpointMediaStatus, `{"faults": [{"kind": "error", "status": 500, "probability": 1}]}`))
+
+	resp, err := http.Get(server.URL + "/mediastatus/device-1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,6 +9,8 @@ import (
 	rand "math/rand"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
@@ -25,40 +28,151 @@ func ValidateConfigPath(configPath string) error {
 	return nil
 }
 
-func parseFlags() (string, error) {
+func parseFlags() (string, int64, error) {
 	var configPath string
+	var seed int64
 
 	flag.StringVar(&configPath, "config", "./config.yaml", "the path to the vendor config file. Defaults to the config.yaml file")
+	flag.Int64Var(&seed, "seed", 0, "the seed of the random media statuses and faults, to reproduce a run. Defaults to a time based seed")
 
 	flag.Parse()
 
 	if err := ValidateConfigPath(configPath); err != nil {
-		return "", err
+		return "", 0, err
 	}
+	// any seed, 0 included, can be passed back; only a missing -seed picks a new one
+	seedSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			seedSet = true
+		}
+	})
+	if !seedSet {
+		seed = time.Now().UnixNano()
+	}
+
+	return configPath, seed, nil
+}
+
+// endpoint names, used to configure the faults of an endpoint
+const (
+	endpointMediaStatus = "mediastatus"
+	endpointMediaURLs   = "mediaurls"
+	endpointMedia       = "media"
+)
+
+func isEndpointName(name string) bool {
+	switch name {
+	case endpointMediaStatus, endpointMediaURLs, endpointMedia:
+		return true
+	}
+	return false
+}
+
+// isJSONEndpoint reports whether the endpoint answers with a small json body rather than a media file
+func isJSONEndpoint(name string) bool {
+	return name == endpointMediaStatus || name == endpointMediaURLs
+}
+
+// faultSeedOffset derives the seed of the fault source from the seed of the run
+const faultSeedOffset = 0x5eed
+
+// vendorServer serves the simulated vendor API. Devices with a scenario get its scripted statuses; the others
+// get a random status drawn from a seeded source, so that a run can be reproduced with the same seed. The injected
+// faults and latencies are drawn from a separate source derived from the same seed, so that configuring faults does
+// not change the statuses of a run.
+type vendorServer struct {
+	config *VendorConfig
+
+	seed int64
 
-	return configPath, nil
+	mu         sync.Mutex
+	statusRand *rand.Rand
+	faultRand  *rand.Rand
+	scenarios  map[string]*scenarioPlayer
+	faults     map[string]EndpointFaults
+	// addedMedia holds the media URLs added to a device at runtime; added media files live in the device's directory
+	addedMedia map[string][]string
+	// requests is the log of the most recent requests to the vendor endpoints
+	requests []requestLogEntry
+	// statuses holds the last media status of every device, to notify the callbacks of its changes
+	statuses  map[string]string
+	callbacks map[string]*callback
 }
 
-func (config VendorConfig) mediaStatusHandler(w http.ResponseWriter, r *http.Request) {
+func newVendorServer(config *VendorConfig, seed int64) *vendorServer {
+	s := &vendorServer{
+		config:    config,
+		seed:      seed,
+		scenarios: map[string]*scenarioPlayer{},
+		faults:    map[string]EndpointFaults{},
+
+		addedMedia: map[string][]string{},
+		statuses:   map[string]string{},
+		callbacks:  map[string]*callback{},
+	}
+	s.seedSources()
+	for deviceID, scenario := range config.Scenarios {
+		s.scenarios[deviceID] = &scenarioPlayer{scenario: scenario}
+	}
+	for endpoint, faults := range config.Faults {
+		s.faults[endpoint] = faults
+	}
+	for _, callback := range config.Callbacks.URLs {
+		s.addCallback(callback, true)
+	}
+	return s
+}
+
+func (s *vendorServer) mediaStatusHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("mediaStatusHandler request obtained.")
 	vars := mux.Vars(r)
 	deviceId, ok := vars["deviceId"]
 	if !ok {
 		fmt.Println("deviceId is missing in parameters")
 	}
-	var status string
-
-	successRatioThreshold := config.Server.Options.MediaStatusSuccessRatio
-	if rand.Float64() <= successRatioThreshold {
-		status = media_processing_workflow.Success
-	} else {
-		// return either `non_obtainable` or `pending` with equal probability
-		if rand.Float64() <= 0.5 {
-			status = media_processing_workflow.NotObtainable
-		} else {
-			status = media_processing_workflow.Pending
+	if !s.requireKnownDevice(w, deviceId) {
+		return
+	}
+
+	s.mu.Lock()
+	if player, ok := s.scenarios[deviceId]; ok {
+		step := player.next()
+		if step.HTTPStatus == 0 {
+			s.recordStatus(deviceId, step.Status)
 		}
+		s.mu.Unlock()
+		writeScenarioStep(w, r, deviceId, step)
+		return
 	}
+	status := s.randomStatus()
+	s.recordStatus(deviceId, status)
+	s.mu.Unlock()
+
+	writeMediaStatus(w, deviceId, status)
+}
+
+// seedSources seeds the random sources of the statuses and the faults with the seed of the run; the caller holds s.mu
+// or has not shared s yet
+func (s *vendorServer) seedSources() {
+	s.statusRand = rand.New(rand.NewSource(s.seed))
+	s.faultRand = rand.New(rand.NewSource(s.seed + faultSeedOffset))
+}
+
+// randomStatus draws a status with the configured success ratio; the caller holds s.mu
+func (s *vendorServer) randomStatus() string {
+	successRatioThreshold := s.config.Server.Options.MediaStatusSuccessRatio
+	if s.statusRand.Float64() <= successRatioThreshold {
+		return media_processing_workflow.Success
+	}
+	// return either `non_obtainable` or `pending` with equal probability
+	if s.statusRand.Float64() <= 0.5 {
+		return media_processing_workflow.NotObtainable
+	}
+	return media_processing_workflow.Pending
+}
+
+func writeMediaStatus(w http.ResponseWriter, deviceId string, status string) {
 	mediaStatus := media_processing_workflow.MediaStatus{DeviceId: deviceId, Status: status}
 	js, err := json.Marshal(mediaStatus)
 	if err != nil {
@@ -69,14 +183,23 @@ func (config VendorConfig) mediaStatusHandler(w http.ResponseWriter, r *http.Req
 	w.Write(js)
 }
 
-func (config VendorConfig) mediaUrls(w http.ResponseWriter, r *http.Request) {
+func (s *vendorServer) mediaUrls(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	deviceId, ok := vars["deviceId"]
 	if !ok {
 		fmt.Println("deviceId is missing in parameters")
 	}
 
-	mediaURLs := media_processing_workflow.MediaURLs{DeviceId: deviceId, Links: config.Server.Options.MediaURLs}
+	if !s.requireKnownDevice(w, deviceId) {
+		return
+	}
+
+	links, err := s.deviceMediaURLs(deviceId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mediaURLs := media_processing_workflow.MediaURLs{DeviceId: deviceId, Links: links}
 	js, err := json.Marshal(mediaURLs)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -87,11 +210,55 @@ func (config VendorConfig) mediaUrls(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func (config VendorConfig) RunServer() {
+// requireKnownDevice answers 404 for devices the simulator does not know and reports whether the device is known
+func (s *vendorServer) requireKnownDevice(w http.ResponseWriter, deviceId string) bool {
+	known, err := s.knownDevice(deviceId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !known {
+		http.Error(w, fmt.Sprintf("unknown device %s", deviceId), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// router routes the vendor endpoints, the admin API and the callback registrations
+func (s *vendorServer) router() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/mediastatus/{deviceId}", config.mediaStatusHandler)
-	r.HandleFunc("/mediaurls/{deviceId}", config.mediaUrls)
-	portAddress := fmt.Sprintf(":%s", config.Server.Port)
+	r.HandleFunc("/mediastatus/{deviceId}", s.mediaStatusHandler).Name(endpointMediaStatus)
+	r.HandleFunc("/mediaurls/{deviceId}", s.mediaUrls).Name(endpointMediaURLs)
+	if s.config.Media.Dir != "" {
+		r.HandleFunc("/media/{file}", s.mediaFileHandler).Methods(http.MethodGet, http.MethodHead).Name(endpointMedia)
+		r.HandleFunc("/media/{deviceId}/{file}", s.mediaFileHandler).Methods(http.MethodGet, http.MethodHead).Name(endpointMedia)
+	}
+
+	// the admin API drives the simulator from test harnesses; its routes have no name, so they get no faults and are
+	// not logged
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/state", s.stateHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/reset", s.resetHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/devices/{deviceId}/media", s.addMediaHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/devices/{deviceId}/status", s.setStatusHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/devices/{deviceId}/scenario", s.setScenarioHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/devices/{deviceId}/scenario", s.deleteScenarioHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/faults/{endpoint}", s.setFaultsHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/faults/{endpoint}", s.deleteFaultsHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/requests", s.requestLogHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/requests", s.clearRequestLogHandler).Methods(http.MethodDelete)
+
+	// callbacks registered here are notified when the media of a device stops being pending, as real vendors do
+	r.HandleFunc("/callbacks", s.registerCallbackHandler).Methods(http.MethodPost)
+	r.HandleFunc("/callbacks", s.callbacksHandler).Methods(http.MethodGet)
+	r.HandleFunc("/callbacks/{id}", s.unregisterCallbackHandler).Methods(http.MethodDelete)
+	r.Use(s.requestLogMiddleware, s.faultMiddleware)
+	return r
+}
+
+func (s *vendorServer) RunServer() {
+	r := s.router()
+	portAddress := fmt.Sprintf(":%s", s.config.Server.Port)
 
 	// server for API endpoints that the workflow can utilize
 	fmt.Println("Starting simulated vendor server...")
@@ -100,7 +267,7 @@ func (config VendorConfig) RunServer() {
 
 func main() {
 
-	vendorCfgPath, err := parseFlags()
+	vendorCfgPath, seed, err := parseFlags()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -109,5 +276,13 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg.RunServer()
+
+	fmt.Printf("Random media statuses and faults use seed %d; run with -seed %d to reproduce them\n", seed, seed)
+	server := newVendorServer(cfg, seed)
+	if cfg.Media.Dir != "" {
+		if err := server.prepareMedia(context.Background()); err != nil {
+			log.Println("Unable to prepare the local media:", err)
+		}
+	}
+	server.RunServer()
 }
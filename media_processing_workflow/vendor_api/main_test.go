@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestConfig returns a config without devices, so that every device is known and gets random statuses
+func newTestConfig() *VendorConfig {
+	config := &VendorConfig{}
+	config.Server.Options.MediaStatusSuccessRatio = 0.5
+	config.Callbacks = CallbacksConfig{MaxAttempts: 3, RetryInterval: 10 * time.Millisecond, Timeout: time.Second}
+	return config
+}
+
+func drawStatuses(s *vendorServer, n int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]string, n)
+	for i := range statuses {
+		statuses[i] = s.randomStatus()
+	}
+	return statuses
+}
+
+func Test_Seed_Reproducible(t *testing.T) {
+	// 0 is a seed like any other
+	expected := drawStatuses(newVendorServer(newTestConfig(), 0), 20)
+	assert.Equal(t, expected, drawStatuses(newVendorServer(newTestConfig(), 0), 20))
+	assert.NotEqual(t, expected, drawStatuses(newVendorServer(newTestConfig(), 1), 20))
+
+	// drawing faults and latencies does not change the statuses of the run
+	config := newTestConfig()
+	config.Faults = map[string]EndpointFaults{endpointMediaStatus: {
+		Latency: LatencyConfig{Distribution: LatencyExponential, Mean: time.Millisecond},
+		Faults:  []FaultConfig{{Kind: FaultError, Probability: 0.5, Status: 503}},
+	}}
+	s := newVendorServer(config, 0)
+	statuses := []string{}
+	for i := 0; i < 20; i++ {
+		s.drawFaults(endpointMediaStatus)
+		statuses = append(statuses, drawStatuses(s, 1)...)
+	}
+	assert.Equal(t, expected, statuses)
+
+	s.reset()
+	assert.Equal(t, expected, drawStatuses(s, 20))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// MediaConfig configures the media files served by the simulator, so that the workflow runs without internet access
+type MediaConfig struct {
+	// Dir holds the served media files; serving local media is disabled when empty
+	Dir string `yaml:"dir"`
+	// BaseURL is the URL the simulator is reached at, used to build the media URLs; defaults to http://host:port
+	BaseURL string `yaml:"base_url"`
+	// ThrottleBytesPerSecond limits the download speed of every media file; zero is unlimited
+	ThrottleBytesPerSecond int64 `yaml:"throttle_bytes_per_second"`
+	// Generate configures the synthetic clips generated when Dir is empty
+	Generate struct {
+		Clips    int           `yaml:"clips"`
+		Duration time.Duration `yaml:"duration"`
+		Size     string        `yaml:"size"`
+	} `yaml:"generate"`
+}
+
+// generated clips show a different test pattern and play a different tone each
+var (
+	clipPatterns = []string{"testsrc2", "smptehdbars", "rgbtestsrc", "testsrc"}
+	clipTones    = []int{440, 554, 659, 880}
+)
+
+// mediaFiles returns the names of the media files in dir
+func mediaFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && isMediaFileName(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isMediaFileName reports whether name can be served, or name a device directory: a plain file name that is not hidden
+func isMediaFileName(name string) bool {
+	return name != "" && filepath.Base(name) == name && !strings.HasPrefix(name, ".")
+}
+
+// mediaURL returns the URL the media file at the path below the media directory is served at
+func (s *vendorServer) mediaURL(path string) string {
+	baseURL := s.config.Media.BaseURL
+	if baseURL == "" {
+		host := s.config.Server.Host
+		if host == "" {
+			host = "localhost"
+		}
+		baseURL = fmt.Sprintf("http://%s:%s", host, s.config.Server.Port)
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/media/" + path
+}
+
+// localMediaURLs returns the URLs of the media files in the subdirectory of the media directory; "" lists the
+// shared media files at its top
+func (s *vendorServer) localMediaURLs(subdir string) ([]string, error) {
+	names, err := mediaFiles(filepath.Join(s.config.Media.Dir, subdir))
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, len(names))
+	for i, name := range names {
+		urls[i] = s.mediaURL(path.Join(subdir, name))
+	}
+	return urls, nil
+}
+
+// mediaFileHandler handles GET /media/{file} and GET /media/{deviceId}/{file}. Range and conditional requests are
+// answered by http.ServeContent, with an ETag derived from the size and modification time of the file.
+func (s *vendorServer) mediaFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["file"]
+	deviceID, perDevice := vars["deviceId"]
+	if !isMediaFileName(name) || (perDevice && !isMediaFileName(deviceID)) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.config.Media.Dir, deviceID, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+strconv.FormatInt(info.Size(), 16)+"-"+strconv.FormatInt(info.ModTime().UnixNano(), 16)+`"`)
+	if rate := s.config.Media.ThrottleBytesPerSecond; rate > 0 {
+		w = &throttledWriter{ResponseWriter: w, request: r, bytesPerSecond: rate, start: time.Now()}
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// throttledWriter holds back the writes so that the body is sent at no more than bytesPerSecond
+type throttledWriter struct {
+	http.ResponseWriter
+	request        *http.Request
+	bytesPerSecond int64
+	start          time.Time
+	written        int64
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		// write at most a tenth of a second worth of data at a time, so the rate holds for large writes too
+		chunk := b
+		if max := t.bytesPerSecond/10 + 1; int64(len(chunk)) > max {
+			chunk = chunk[:max]
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		total += n
+		t.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+
+		due := t.start.Add(time.Duration(float64(t.written) / float64(t.bytesPerSecond) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			select {
+			case <-time.After(wait):
+			case <-t.request.Context().Done():
+				return total, t.request.Context().Err()
+			}
+		}
+	}
+	return total, nil
+}
+
+func (t *throttledWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// prepareMedia creates the media directory and, when it has no shared media files, fills it with synthetic clips
+// generated by the ffmpeg lavfi test sources
+func (s *vendorServer) prepareMedia(ctx context.Context) error {
+	dir := s.config.Media.Dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	names, err := mediaFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 || s.config.Media.Generate.Clips <= 0 {
+		return nil
+	}
+
+	for i := 0; i < s.config.Media.Generate.Clips; i++ {
+		name := fmt.Sprintf("clip-%d.mp4", i+1)
+		fmt.Printf("Generating synthetic clip %s...\n", name)
+		if err := s.generateClip(ctx, i, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *vendorServer) generateClip(ctx context.Context, index int, fileName string) error {
+	generate := s.config.Media.Generate
+	duration := strconv.FormatFloat(generate.Duration.Seconds(), 'f', -1, 64)
+	pattern := clipPatterns[index%len(clipPatterns)]
+	tone := clipTones[index%len(clipTones)]
+
+	// the clip is generated under a temporary name, so an interrupted run does not leave a partial clip behind
+	tmpName := filepath.Join(filepath.Dir(fileName), "."+filepath.Base(fileName))
+	defer os.Remove(tmpName)
+	cmd := exec.CommandContext(ctx, media_processing_workflow.FFmpegCommand, "-y", "-v", "error",
+		"-f", "lavfi", "-i", fmt.Sprintf("%s=size=%s:rate=30:duration=%s", pattern, generate.Size, duration),
+		"-f", "lavfi", "-i", fmt.Sprintf("sine=frequency=%d:duration=%s", tone, duration),
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac", "-shortest",
+		"-f", "mp4", tmpName)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("generating %s: %v: %s", fileName, err, strings.TrimSpace(string(output)))
+	}
+	return os.Rename(tmpName, fileName)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
+)
+
+// Scenario scripts the answers of /mediastatus for a single device. Every request plays the current step;
+// once every step has been played, the last step is played for all further requests.
+type Scenario struct {
+	Steps []ScenarioStep `yaml:"steps" json:"steps,omitempty"`
+}
+
+// ScenarioStep is a single scripted answer, e.g. `{status: pending, repeat: 3}` or `{http_status: 500}`
+type ScenarioStep struct {
+	// Status is the media status returned
+	Status string `yaml:"status" json:"status,omitempty"`
+	// HTTPStatus answers with this error status instead of a media status
+	HTTPStatus int `yaml:"http_status" json:"http_status,omitempty"`
+	// Delay holds back the answer to simulate a slow vendor
+	Delay time.Duration `yaml:"delay" json:"delay,omitempty"`
+	// Repeat is the number of requests answered by the step; defaults to 1
+	Repeat int `yaml:"repeat" json:"repeat,omitempty"`
+}
+
+func (s Scenario) validate(deviceID string) error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("scenario %q has no steps", deviceID)
+	}
+	for i, step := range s.Steps {
+		switch {
+		case step.HTTPStatus != 0 && step.Status != "":
+			return fmt.Errorf("step %d of scenario %q sets both status and http_status", i+1, deviceID)
+		case step.HTTPStatus != 0 && (step.HTTPStatus < 400 || step.HTTPStatus > 599):
+			return fmt.Errorf("step %d of scenario %q has http_status %d, which is not an error status", i+1, deviceID, step.HTTPStatus)
+		case step.HTTPStatus == 0 && !isMediaStatus(step.Status):
+			return fmt.Errorf("step %d of scenario %q has unknown status %q", i+1, deviceID, step.Status)
+		case step.Repeat < 0 || step.Delay < 0:
+			return fmt.Errorf("step %d of scenario %q has a negative repeat or delay", i+1, deviceID)
+		}
+	}
+	return nil
+}
+
+func isMediaStatus(status string) bool {
+	switch status {
+	case media_processing_workflow.Success, media_processing_workflow.Pending, media_processing_workflow.NotObtainable:
+		return true
+	}
+	return false
+}
+
+// scenarioPlayer tracks how far the scenario of a device has been played
+type scenarioPlayer struct {
+	scenario Scenario
+	step     int
+	played   int
+}
+
+// next returns the step answering the current request and advances the scenario
+func (p *scenarioPlayer) next() ScenarioStep {
+	step := p.scenario.Steps[p.step]
+	p.played++
+	repeat := step.Repeat
+	if repeat == 0 {
+		repeat = 1
+	}
+	if p.played >= repeat && p.step < len(p.scenario.Steps)-1 {
+		p.step++
+		p.played = 0
+	}
+	return step
+}
+
+// writeScenarioStep answers a /mediastatus request with a scripted step
+func writeScenarioStep(w http.ResponseWriter, r *http.Request, deviceID string, step ScenarioStep) {
+	if step.Delay > 0 {
+		select {
+		case <-time.After(step.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if step.HTTPStatus != 0 {
+		http.Error(w, fmt.Sprintf("scripted %d for device %s", step.HTTPStatus, deviceID), step.HTTPStatus)
+		return
+	}
+	writeMediaStatus(w, deviceID, step.Status)
+}
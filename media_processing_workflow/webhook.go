@@ -0,0 +1,90 @@
+package media_processing_workflow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxWebhookRetryInterval caps the doubling interval between delivery attempts when MaxRetryInterval is unset
+const DefaultMaxWebhookRetryInterval = time.Minute
+
+// WebhookSender posts webhook deliveries to a URL, signed with SignWebhookRequest when it has a secret, and retries
+// failed deliveries at a doubling interval. The internal api delivers its upload events and the vendor api its
+// callback notifications with it.
+type WebhookSender struct {
+	URL    string
+	Secret string
+	Client *http.Client
+	// MaxAttempts is the number of attempts made before giving up on a delivery; at least one attempt is made
+	MaxAttempts      int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// OnRetry, when set, is called before waiting for the next attempt of a failed delivery
+	OnRetry func(id string, attempt int, wait time.Duration, err error)
+}
+
+// Deliver posts the body with the delivery ID in the X-Webhook-Id header until the receiver accepts it with a 2xx,
+// rejects it with a 4xx other than 408 or 429, the attempts are used up or ctx is done. Every attempt is signed
+// with its own timestamp, so that retries are not rejected as stale.
+func (s *WebhookSender) Deliver(ctx context.Context, id string, body []byte) error {
+	maxInterval := s.MaxRetryInterval
+	if maxInterval <= 0 {
+		maxInterval = DefaultMaxWebhookRetryInterval
+	}
+	interval := s.RetryInterval
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, id, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		if s.OnRetry != nil {
+			s.OnRetry(id, attempt, interval, err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// post sends a single delivery and reports whether a failed delivery is worth retrying: receivers rejecting it
+// outright, with a 4xx other than 408 or 429, will reject it again
+func (s *WebhookSender) post(ctx context.Context, id string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, id)
+	if s.Secret != "" {
+		SignWebhookRequest(req, []byte(s.Secret), body, time.Now())
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s answered %s", s.URL, resp.Status)
+	default:
+		return false, fmt.Errorf("%s answered %s", s.URL, resp.Status)
+	}
+}
@@ -0,0 +1,88 @@
+package media_processing_workflow
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WebhookSender_Deliver(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	var bodies [][]byte
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(statuses[(len(requests)-1)%len(statuses)])
+	}))
+	defer receiver.Close()
+
+	var waits []time.Duration
+	sender := &WebhookSender{
+		URL:              receiver.URL,
+		Secret:           "secret",
+		MaxAttempts:      3,
+		RetryInterval:    10 * time.Millisecond,
+		MaxRetryInterval: 15 * time.Millisecond,
+		OnRetry: func(id string, attempt int, wait time.Duration, err error) {
+			waits = append(waits, wait)
+		},
+	}
+	body := []byte(`{"id":"delivery-1"}`)
+	require.NoError(t, sender.Deliver(context.Background(), "delivery-1", body))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, requests, 3)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 15 * time.Millisecond}, waits)
+	for i, r := range requests {
+		assert.Equal(t, body, bodies[i])
+		assert.Equal(t, "delivery-1", r.Header.Get(WebhookIDHeader))
+		assert.NoError(t, VerifyPayloadSignature([]byte("secret"), bodies[i], r.Header.Get(WebhookTimestampHeader),
+			r.Header.Get(WebhookSignatureHeader), time.Now(), DefaultWebhookTolerance))
+	}
+}
+
+func Test_WebhookSender_GivesUp(t *testing.T) {
+	attempts := map[string]int{}
+	var mu sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		mu.Unlock()
+		assert.Empty(t, r.Header.Get(WebhookSignatureHeader))
+		if r.URL.Path == "/rejecting" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	sender := &WebhookSender{URL: receiver.URL + "/rejecting", MaxAttempts: 3, RetryInterval: time.Millisecond}
+	assert.Error(t, sender.Deliver(context.Background(), "delivery-1", []byte(`{}`)))
+	sender = &WebhookSender{URL: receiver.URL + "/failing", MaxAttempts: 3, RetryInterval: time.Millisecond}
+	assert.EqualError(t, sender.Deliver(context.Background(), "delivery-2", []byte(`{}`)),
+		"giving up after 3 attempts: "+receiver.URL+"/failing answered 500 Internal Server Error")
+
+	// a canceled delivery stops waiting for its next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	sender = &WebhookSender{URL: receiver.URL + "/canceled", MaxAttempts: 3, RetryInterval: time.Hour,
+		OnRetry: func(string, int, time.Duration, error) { cancel() }}
+	assert.Equal(t, context.Canceled, sender.Deliver(ctx, "delivery-3", []byte(`{}`)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"/rejecting": 1, "/failing": 3, "/canceled": 1}, attempts)
+}
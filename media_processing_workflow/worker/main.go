@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"os"
+	"time"
 
 	"github.com/nirpadma/temporal-workflows/media_processing_workflow"
 	"github.com/xfrr/goffmpeg/transcoder"
@@ -9,6 +11,8 @@ import (
 	"go.temporal.io/sdk/worker"
 )
 
+const workspaceJanitorInterval = 10 * time.Minute
+
 func main() {
 	// The client and worker are heavyweight objects that should be created once per process.
 	c, err := client.NewClient(client.Options{
@@ -33,11 +37,38 @@ func main() {
 		Transcoder:                   transcoder,
 		OutputFileType:               media_processing_workflow.EncodedOutputFileType,
 		FileUploadEndpoint:           media_processing_workflow.FileUploadEndpoint,
+		ResumableUploadEndpoint:      media_processing_workflow.ResumableUploadEndpoint,
+		// the object store of s3:// destinations is configured through the environment
+		S3: media_processing_workflow.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("AWS_REGION"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		},
+		// uploads to the internal API are authenticated with a signed token when a secret is configured,
+		// with a static API key otherwise
+		UploadCredentials: media_processing_workflow.UploadCredentials{
+			APIKey:      os.Getenv("INTERNAL_API_KEY"),
+			TokenSecret: os.Getenv("INTERNAL_API_TOKEN_SECRET"),
+		},
 	}
 
 	w.RegisterWorkflow(media_processing_workflow.MediaProcessingWorkflow)
 	w.RegisterActivity(&activity)
 
+	// workspaces retained for debugging are removed by the worker once their retention ends
+	go func() {
+		for ; ; time.Sleep(workspaceJanitorInterval) {
+			removed, err := activity.RemoveExpiredWorkspaces(time.Now())
+			if err != nil {
+				log.Println("Unable to remove expired workspaces", err)
+			}
+			for _, dir := range removed {
+				log.Println("Removed expired workspace", dir)
+			}
+		}
+	}()
+
 	err = w.Run(worker.InterruptCh())
 	if err != nil {
 		log.Fatalln("Unable to start worker", err)
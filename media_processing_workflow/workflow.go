@@ -1,6 +1,7 @@
 package media_processing_workflow
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -8,13 +9,64 @@ import (
 	"go.temporal.io/sdk/workflow"
 )
 
-const sessionMaxAttempts = 3
+const (
+	sessionMaxAttempts     = 3
+	uploadHeartbeatTimeout = 30 * time.Second
+)
+
+// MediaProcessingOptions holds the optional settings of a MediaProcessingWorkflow execution
+type MediaProcessingOptions struct {
+	// Overwrite allows the merged output to replace a file with the same name at a directory or S3 destination; the
+	// internal API never replaces a stored file and fails the workflow when it is set
+	Overwrite bool
+	// NormalizeLoudness applies EBU R128 loudness normalization to every clip before merging
+	NormalizeLoudness bool
+	// AudioOnly produces a merged output without video
+	AudioOnly bool
+	// EncodingProfile is applied to every clip by EncodeFileActivity
+	EncodingProfile EncodingProfile
+	// ClipRanges trims each clip, matched to the media URLs by position; missing or zero ranges keep the whole clip
+	ClipRanges []ClipRange
+	// TimeRange trims the concatenated timeline after the clips are merged
+	TimeRange ClipRange
+	// Destination is the URI the merged output is stored at, e.g. file:///mnt/media or s3://bucket/prefix;
+	// empty stores it through the internal API
+	Destination string
+	// RetainArtifactsFor keeps the workspace of every session, including the merged output, on the worker host
+	// for debugging; zero deletes the artifacts as soon as they are no longer needed
+	RetainArtifactsFor time.Duration
+}
+
+// MediaProcessingResult is the result of a MediaProcessingWorkflow execution
+type MediaProcessingResult struct {
+	// MediaStatus is the final status reported by the vendor
+	MediaStatus string
+	// MergedFileName is the name of the merged output on the worker that produced it
+	MergedFileName string
+	MergeStrategy  string
+	// Duration of the merged output, after trimming
+	Duration time.Duration
+	// Upload identifies the merged output stored at the destination
+	Upload UploadResult
+}
 
 // MediaProcessingWorkflow defines a workflow that queries an API, downloads media files, encodes, and combines media.
 // NOTE: The initial structure for this workflow was inspired by https://github.com/temporalio/samples-go
-func MediaProcessingWorkflow(ctx workflow.Context, deviceId string, outputFileName string) (err error) {
+func MediaProcessingWorkflow(ctx workflow.Context, deviceId string, outputFileName string, options MediaProcessingOptions) (result MediaProcessingResult, err error) {
 
 	logger := workflow.GetLogger(ctx)
+	if err = validateDestination(options.Destination, options.Overwrite); err != nil {
+		logger.Error("Invalid destination", "Error", err)
+		return result, err
+	}
+	// the output is stored under its name at the destination, so it cannot carry a directory of the worker host
+	if !isPlainFileName(outputFileName) {
+		err = temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("output file name %q must not contain a directory", outputFileName), ErrTypeInvalidOutputName, nil)
+		logger.Error("Invalid output file name", "Error", err)
+		return result, err
+	}
+
 	// use an exponential retry policy for activities where "real world" delays may occur
 	expAO := workflow.ActivityOptions{
 		StartToCloseTimeout:    1 * time.Minute,
@@ -30,14 +82,15 @@ func MediaProcessingWorkflow(ctx workflow.Context, deviceId string, outputFileNa
 	err = workflow.ExecuteActivity(ctx, a.CheckMediaStatusActivity, deviceId).Get(ctx, &status)
 	if err != nil {
 		logger.Error("CheckMediaStatusActivity failed", "Error", err)
-		return err
+		return result, err
 	}
+	result.MediaStatus = status
 
 	// End the workflow early if the media is never obtainable
 	if status == NotObtainable {
 		logger.Info("Media not obtainable; finishing workflow")
 		// any clean-up activities would go here.
-		return nil
+		return result, nil
 	}
 
 	uniformAO := workflow.ActivityOptions{
@@ -53,26 +106,60 @@ func MediaProcessingWorkflow(ctx workflow.Context, deviceId string, outputFileNa
 	err = workflow.ExecuteActivity(ctx, a.GetMediaURLsActivity, deviceId).Get(ctx, &mediaURLs)
 	if err != nil {
 		logger.Error("GetMediaURLsActivity failed", "Error", err)
-		return err
+		return result, err
+	}
+	if len(options.ClipRanges) > len(mediaURLs) {
+		return result, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("%d clip ranges provided for %d media files", len(options.ClipRanges), len(mediaURLs)), ErrTypeInvalidClipRange, nil)
 	}
 
 	for i := 1; i <= sessionMaxAttempts; i++ {
-		err = processMediaFiles(ctx, mediaURLs, outputFileName)
+		var mergeResult MergeResult
+		var uploadResult UploadResult
+		mergeResult, uploadResult, err = processMediaFiles(ctx, deviceId, mediaURLs, outputFileName, options)
 		if err == nil {
+			result.MergedFileName = mergeResult.FileName
+			result.MergeStrategy = mergeResult.Strategy
+			result.Duration = mergeResult.Duration
+			result.Upload = uploadResult
+			break
+		}
+		if isNonRetryable(err) {
+			logger.Error("processMediaFiles failed with a non-retryable error.")
 			break
-		} 
+		}
 		logger.Error("processMediaFiles errored. Retrying...")
 	}
 
 	if err != nil {
 		logger.Error("Processing Media in Session Failed.", "Error", err.Error())
 	} else {
-		logger.Info("Processing Media in Session Succeeded.")
+		logger.Info("Processing Media in Session Succeeded.", "duration", result.Duration, "location", result.Upload.Location)
+	}
+	return result, err
+}
+
+func (o MediaProcessingOptions) mergeOptions() MergeOptions {
+	return MergeOptions{
+		NormalizeLoudness: o.NormalizeLoudness,
+		AudioOnly:         o.AudioOnly,
+		Range:             o.TimeRange,
 	}
-	return err
 }
 
-func processMediaFiles(ctx workflow.Context, mediaFilesOfInterest []string, outputFileName string) (err error) {
+func (o MediaProcessingOptions) encodeParams(deviceId string, clipIndex int) EncodeParams {
+	params := EncodeParams{DeviceID: deviceId, ClipIndex: clipIndex, Profile: o.EncodingProfile}
+	if clipIndex < len(o.ClipRanges) {
+		params.Range = o.ClipRanges[clipIndex]
+	}
+	return params
+}
+
+func (o MediaProcessingOptions) uploadParams(deviceId string) UploadParams {
+	return UploadParams{Destination: o.Destination, DeviceID: deviceId, Overwrite: o.Overwrite}
+}
+
+func processMediaFiles(ctx workflow.Context, deviceId string, mediaFilesOfInterest []string, outputFileName string, options MediaProcessingOptions) (mergeResult MergeResult, uploadResult UploadResult, err error) {
 	// Create and use the session API for the activities that need to be scheduled on the same host
 	so := &workflow.SessionOptions{
 		CreationTimeout:  3 * time.Minute,
@@ -81,7 +168,7 @@ func processMediaFiles(ctx workflow.Context, mediaFilesOfInterest []string, outp
 
 	sessionCtx, err := workflow.CreateSession(ctx, so)
 	if err != nil {
-		return err
+		return mergeResult, uploadResult, err
 	}
 	defer workflow.CompleteSession(sessionCtx)
 
@@ -89,35 +176,72 @@ func processMediaFiles(ctx workflow.Context, mediaFilesOfInterest []string, outp
 
 	var a *Activities
 
+	// every file produced during the session lives in the workspace, which is removed before the session completes
+	var ws Workspace
+	err = workflow.ExecuteActivity(sessionCtx, a.CreateWorkspaceActivity).Get(sessionCtx, &ws)
+	if err != nil {
+		return mergeResult, uploadResult, err
+	}
+	defer func() {
+		if options.RetainArtifactsFor > 0 {
+			retainUntil := workflow.Now(sessionCtx).Add(options.RetainArtifactsFor)
+			retainErr := workflow.ExecuteActivity(sessionCtx, a.RetainWorkspaceActivity, ws, retainUntil).Get(sessionCtx, nil)
+			if retainErr != nil {
+				logger.Error("RetainWorkspaceActivity failed", "Error", retainErr)
+			}
+			return
+		}
+		removeErr := workflow.ExecuteActivity(sessionCtx, a.RemoveWorkspaceActivity, ws).Get(sessionCtx, nil)
+		if removeErr != nil {
+			logger.Error("RemoveWorkspaceActivity failed", "Error", removeErr)
+		}
+	}()
+
 	downloadedfileNames := []string{}
-	err = workflow.ExecuteActivity(sessionCtx, a.DownloadFilesActivity, mediaFilesOfInterest).Get(sessionCtx, &downloadedfileNames)
+	err = workflow.ExecuteActivity(sessionCtx, a.DownloadFilesActivity, ws, mediaFilesOfInterest).Get(sessionCtx, &downloadedfileNames)
 	if err != nil {
-		return err
+		return mergeResult, uploadResult, err
 	}
 
 	encodedfileNames := []string{}
-	for _, downloadedFile := range downloadedfileNames {
+	for i, downloadedFile := range downloadedfileNames {
 		logger.Info("encoding file", "file", downloadedFile)
 		var encodedFileName string
-		err = workflow.ExecuteActivity(sessionCtx, a.EncodeFileActivity, downloadedFile).Get(sessionCtx, &encodedFileName)
+		err = workflow.ExecuteActivity(sessionCtx, a.EncodeFileActivity, ws, downloadedFile, options.encodeParams(deviceId, i)).Get(sessionCtx, &encodedFileName)
 		if err != nil {
-			return err
+			return mergeResult, uploadResult, err
 		}
 		logger.Info(fmt.Sprintf("Encoded the following file: %s", encodedFileName))
 		encodedfileNames = append(encodedfileNames, encodedFileName)
 	}
 
-	var mergedFile string
-	err = workflow.ExecuteActivity(sessionCtx, a.MergeFilesActivity, encodedfileNames, outputFileName).Get(sessionCtx, &mergedFile)
+	err = workflow.ExecuteActivity(sessionCtx, a.MergeFilesActivity, ws, encodedfileNames, outputFileName, options.mergeOptions()).Get(sessionCtx, &mergeResult)
 	if err != nil {
-		return err
+		return mergeResult, uploadResult, err
 	}
+	logger.Info("Merged files", "file", mergeResult.FileName, "strategy", mergeResult.Strategy, "reason", mergeResult.Reason, "duration", mergeResult.Duration)
 
-	var uploadSuccess bool
-	err = workflow.ExecuteActivity(sessionCtx, a.UploadFileActivity, mergedFile).Get(sessionCtx, &uploadSuccess)
+	// the upload heartbeats its progress, so a stalled transfer is detected long before the activity times out
+	uploadCtx := workflow.WithHeartbeatTimeout(sessionCtx, uploadHeartbeatTimeout)
+	err = workflow.ExecuteActivity(uploadCtx, a.UploadFileActivity, mergeResult.FileName, options.uploadParams(deviceId)).Get(uploadCtx, &uploadResult)
 	if err != nil {
-		return err
+		return mergeResult, uploadResult, err
 	}
+	logger.Info("Uploaded merged file", "id", uploadResult.ID, "location", uploadResult.Location)
+
+	// the upload succeeded, so a failure to delete the local copy must not fail the session
+	if options.RetainArtifactsFor == 0 {
+		deleteErr := workflow.ExecuteActivity(sessionCtx, a.DeleteLocalArtifactsActivity, ws, []string{mergeResult.FileName}).Get(sessionCtx, nil)
+		if deleteErr != nil {
+			logger.Error("DeleteLocalArtifactsActivity failed", "Error", deleteErr)
+		}
+	}
+
+	return mergeResult, uploadResult, nil
+}
 
-	return nil
+// isNonRetryable reports whether err wraps an application error that was marked as non-retryable
+func isNonRetryable(err error) bool {
+	var appErr *temporal.ApplicationError
+	return errors.As(err, &appErr) && appErr.NonRetryable()
 }
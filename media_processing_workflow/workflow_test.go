@@ -1,11 +1,15 @@
 package media_processing_workflow
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
 	"go.temporal.io/sdk/worker"
 )
@@ -26,7 +30,7 @@ func (s *UnitTestSuite) Test_MediaProcessingWorkflow_NotObtainable() {
 	env.OnActivity(a.CheckMediaStatusActivity, mock.Anything, mock.Anything).Return(NotObtainable, nil)
 	fileID := uuid.New()
 	outputfileName := "mediaprocessing_" + fileID
-	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", outputfileName)
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", outputfileName, MediaProcessingOptions{})
 
 	s.True(env.IsWorkflowCompleted())
 	s.NoError(env.GetWorkflowError())
@@ -45,19 +49,172 @@ func (s *UnitTestSuite) Test_MediaProcessingWorkflow_NoError() {
 	env.RegisterActivity(a.DownloadFilesActivity)
 	env.RegisterActivity(a.EncodeFileActivity)
 	env.RegisterActivity(a.MergeFilesActivity)
+	env.RegisterActivity(a.CreateWorkspaceActivity)
+	env.RegisterActivity(a.RemoveWorkspaceActivity)
+	env.RegisterActivity(a.DeleteLocalArtifactsActivity)
 
 	env.OnActivity(a.CheckMediaStatusActivity, mock.Anything, mock.Anything).Return(Success, nil)
 	env.OnActivity(a.GetMediaURLsActivity, mock.Anything, mock.Anything).Return([]string{"url1", "url2"}, nil)
-	env.OnActivity(a.DownloadFilesActivity, mock.Anything, []string{"url1", "url2"}).Return([]string{"download1", "download2"}, nil)
-	env.OnActivity(a.EncodeFileActivity, mock.Anything, "download1").Return("encode1", nil)
-	env.OnActivity(a.EncodeFileActivity, mock.Anything, "download2").Return("encode2", nil)
-	env.OnActivity(a.MergeFilesActivity, mock.Anything, []string{"encode1", "encode2"}, mock.Anything).Return("output.mp4", nil)
-	env.OnActivity(a.UploadFileActivity, mock.Anything, "output.mp4", mock.Anything).Return(true, nil)
+	ws := Workspace{Dir: "/tmp/workspace"}
+	env.OnActivity(a.CreateWorkspaceActivity, mock.Anything).Return(ws, nil)
+	env.OnActivity(a.RemoveWorkspaceActivity, mock.Anything, ws).Return(nil).Once()
+	env.OnActivity(a.DownloadFilesActivity, mock.Anything, ws, []string{"url1", "url2"}).Return([]string{"download1", "download2"}, nil)
+	env.OnActivity(a.EncodeFileActivity, mock.Anything, ws, "download1", mock.Anything).Return("encode1", nil)
+	env.OnActivity(a.EncodeFileActivity, mock.Anything, ws, "download2", mock.Anything).Return("encode2", nil)
+	env.OnActivity(a.MergeFilesActivity, mock.Anything, ws, []string{"encode1", "encode2"}, mock.Anything, mock.Anything).Return(MergeResult{FileName: "output.mp4", Strategy: MergeStrategyConcatDemuxer, Duration: 90 * time.Second}, nil)
+	env.OnActivity(a.UploadFileActivity, mock.Anything, "output.mp4", mock.Anything).Return(UploadResult{ID: "1", FileName: "video-1.mp4", Location: "/uploads/video-1.mp4", Size: 1024}, nil)
+	env.OnActivity(a.DeleteLocalArtifactsActivity, mock.Anything, ws, []string{"output.mp4"}).Return(nil).Once()
 
 	fileID := uuid.New()
 	outputfileName := "mediaprocessing_" + fileID
-	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", outputfileName)
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", outputfileName, MediaProcessingOptions{})
 
 	s.True(env.IsWorkflowCompleted())
 	s.NoError(env.GetWorkflowError())
+	env.AssertExpectations(s.T())
+	var result MediaProcessingResult
+	s.NoError(env.GetWorkflowResult(&result))
+	s.Equal(MediaProcessingResult{
+		MediaStatus:    Success,
+		MergedFileName: "output.mp4",
+		MergeStrategy:  MergeStrategyConcatDemuxer,
+		Duration:       90 * time.Second,
+		Upload:         UploadResult{ID: "1", FileName: "video-1.mp4", Location: "/uploads/video-1.mp4", Size: 1024},
+	}, result)
+}
+
+// Test that an output already stored at the destination fails the workflow without retrying in a new session
+func (s *UnitTestSuite) Test_MediaProcessingWorkflow_OutputExists() {
+	env := s.NewTestWorkflowEnvironment()
+	env.SetWorkerOptions(worker.Options{
+		EnableSessionWorker: true,
+	})
+	var a *Activities
+
+	env.OnActivity(a.CheckMediaStatusActivity, mock.Anything, mock.Anything).Return(Success, nil)
+	env.OnActivity(a.GetMediaURLsActivity, mock.Anything, mock.Anything).Return([]string{"url1"}, nil)
+	ws := Workspace{Dir: "/tmp/workspace"}
+	env.OnActivity(a.CreateWorkspaceActivity, mock.Anything).Return(ws, nil).Once()
+	env.OnActivity(a.RemoveWorkspaceActivity, mock.Anything, ws).Return(nil).Once()
+	env.OnActivity(a.DownloadFilesActivity, mock.Anything, ws, []string{"url1"}).Return([]string{"download1"}, nil)
+	env.OnActivity(a.EncodeFileActivity, mock.Anything, ws, "download1", mock.Anything).Return("encode1", nil)
+	env.OnActivity(a.MergeFilesActivity, mock.Anything, ws, []string{"encode1"}, "output.mp4", MergeOptions{}).
+		Return(MergeResult{FileName: "/tmp/workspace/output.mp4"}, nil).Once()
+	env.OnActivity(a.UploadFileActivity, mock.Anything, "/tmp/workspace/output.mp4", UploadParams{Destination: "file:///mnt/media", DeviceID: "deviceId"}).
+		Return(UploadResult{}, temporal.NewNonRetryableApplicationError("exists", ErrTypeOutputExists, nil)).Once()
+
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", "output.mp4", MediaProcessingOptions{Destination: "file:///mnt/media"})
+
+	s.True(env.IsWorkflowCompleted())
+	s.Error(env.GetWorkflowError())
+	env.AssertExpectations(s.T())
+}
+
+// Test that an output file name carrying a directory is rejected before any processing
+func (s *UnitTestSuite) Test_MediaProcessingWorkflow_InvalidOutputName() {
+	env := s.NewTestWorkflowEnvironment()
+
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", "../output.mp4", MediaProcessingOptions{})
+
+	s.True(env.IsWorkflowCompleted())
+	s.Error(env.GetWorkflowError())
+	s.Contains(env.GetWorkflowError().Error(), ErrTypeInvalidOutputName)
+}
+
+// Test that clip ranges reach the encode activities and the time range reaches the merge
+func (s *UnitTestSuite) Test_MediaProcessingWorkflow_ClipRanges() {
+	env := s.NewTestWorkflowEnvironment()
+	env.SetWorkerOptions(worker.Options{
+		EnableSessionWorker: true,
+	})
+	var a *Activities
+	options := MediaProcessingOptions{
+		ClipRanges: []ClipRange{{Start: 2 * time.Second, End: 5 * time.Second}},
+		TimeRange:  ClipRange{End: 4 * time.Second},
+	}
+
+	ws := Workspace{Dir: "/tmp/workspace"}
+	env.OnActivity(a.CheckMediaStatusActivity, mock.Anything, mock.Anything).Return(Success, nil)
+	env.OnActivity(a.GetMediaURLsActivity, mock.Anything, mock.Anything).Return([]string{"url1", "url2"}, nil)
+	env.OnActivity(a.CreateWorkspaceActivity, mock.Anything).Return(ws, nil)
+	env.OnActivity(a.RemoveWorkspaceActivity, mock.Anything, ws).Return(nil)
+	env.OnActivity(a.DownloadFilesActivity, mock.Anything, ws, []string{"url1", "url2"}).Return([]string{"download1", "download2"}, nil)
+	env.OnActivity(a.EncodeFileActivity, mock.Anything, ws, "download1", EncodeParams{DeviceID: "deviceId", ClipIndex: 0, Range: options.ClipRanges[0]}).Return("encode1", nil).Once()
+	env.OnActivity(a.EncodeFileActivity, mock.Anything, ws, "download2", EncodeParams{DeviceID: "deviceId", ClipIndex: 1}).Return("encode2", nil).Once()
+	env.OnActivity(a.MergeFilesActivity, mock.Anything, ws, []string{"encode1", "encode2"}, "output.mp4", MergeOptions{Range: options.TimeRange}).
+		Return(MergeResult{FileName: "output.mp4", Strategy: MergeStrategyConcatFilter, Duration: 4 * time.Second}, nil).Once()
+	env.OnActivity(a.UploadFileActivity, mock.Anything, "output.mp4", UploadParams{DeviceID: "deviceId"}).Return(UploadResult{ID: "1"}, nil)
+	env.OnActivity(a.DeleteLocalArtifactsActivity, mock.Anything, ws, []string{"output.mp4"}).Return(nil)
+
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", "output.mp4", options)
+
+	s.True(env.IsWorkflowCompleted())
+	s.NoError(env.GetWorkflowError())
+	env.AssertExpectations(s.T())
+	var result MediaProcessingResult
+	s.NoError(env.GetWorkflowResult(&result))
+	s.Equal(4*time.Second, result.Duration)
+}
+
+// Test that an invalid destination fails the workflow before any media is processed
+func (s *UnitTestSuite) Test_MediaProcessingWorkflow_InvalidDestination() {
+	env := s.NewTestWorkflowEnvironment()
+
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", "output.mp4", MediaProcessingOptions{Destination: "ftp://example.com/media"})
+
+	s.True(env.IsWorkflowCompleted())
+	var appErr *temporal.ApplicationError
+	s.True(errors.As(env.GetWorkflowError(), &appErr))
+	s.Equal(ErrTypeInvalidDestination, appErr.Type())
+}
+
+// Test that overwrite fails the workflow when the output is stored through the internal API
+func (s *UnitTestSuite) Test_MediaProcessingWorkflow_OverwriteWithoutDestination() {
+	env := s.NewTestWorkflowEnvironment()
+
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", "output.mp4", MediaProcessingOptions{Overwrite: true})
+
+	s.True(env.IsWorkflowCompleted())
+	var appErr *temporal.ApplicationError
+	s.True(errors.As(env.GetWorkflowError(), &appErr))
+	s.Equal(ErrTypeInvalidDestination, appErr.Type())
+}
+
+// Test that retained artifacts are neither deleted nor removed with the workspace
+func (s *UnitTestSuite) Test_MediaProcessingWorkflow_RetainArtifacts() {
+	env := s.NewTestWorkflowEnvironment()
+	env.SetWorkerOptions(worker.Options{
+		EnableSessionWorker: true,
+	})
+	var a *Activities
+	env.RegisterActivity(a.RemoveWorkspaceActivity)
+	env.RegisterActivity(a.DeleteLocalArtifactsActivity)
+	options := MediaProcessingOptions{RetainArtifactsFor: 4 * time.Hour}
+
+	ws := Workspace{Dir: "/tmp/workspace"}
+	env.OnActivity(a.CheckMediaStatusActivity, mock.Anything, mock.Anything).Return(Success, nil)
+	env.OnActivity(a.GetMediaURLsActivity, mock.Anything, mock.Anything).Return([]string{"url1"}, nil)
+	env.OnActivity(a.CreateWorkspaceActivity, mock.Anything).Return(ws, nil)
+	env.OnActivity(a.DownloadFilesActivity, mock.Anything, ws, []string{"url1"}).Return([]string{"download1"}, nil)
+	env.OnActivity(a.EncodeFileActivity, mock.Anything, ws, "download1", mock.Anything).Return("encode1", nil)
+	env.OnActivity(a.MergeFilesActivity, mock.Anything, ws, []string{"encode1"}, "output.mp4", mock.Anything).
+		Return(MergeResult{FileName: "output.mp4", Strategy: MergeStrategyConcatDemuxer}, nil)
+	env.OnActivity(a.UploadFileActivity, mock.Anything, "output.mp4", UploadParams{DeviceID: "deviceId"}).Return(UploadResult{ID: "1"}, nil)
+	retained := false
+	env.OnActivity(a.RetainWorkspaceActivity, mock.Anything, ws, mock.Anything).Return(
+		func(_ context.Context, _ Workspace, until time.Time) error {
+			s.True(env.Now().Add(options.RetainArtifactsFor).Equal(until), until)
+			retained = true
+			return nil
+		})
+	env.OnActivity(a.RemoveWorkspaceActivity, mock.Anything, mock.Anything).Return(nil).
+		Run(func(mock.Arguments) { s.Fail("the retained workspace was removed") })
+	env.OnActivity(a.DeleteLocalArtifactsActivity, mock.Anything, mock.Anything, mock.Anything).Return(nil).
+		Run(func(mock.Arguments) { s.Fail("the retained artifacts were deleted") })
+
+	env.ExecuteWorkflow(MediaProcessingWorkflow, "deviceId", "output.mp4", options)
+
+	s.True(env.IsWorkflowCompleted())
+	s.NoError(env.GetWorkflowError())
+	s.True(retained)
 }
@@ -0,0 +1,190 @@
+package media_processing_workflow
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+const (
+	// DefaultMinFreeDiskBytes is the free space a workspace volume must have before a session starts processing
+	DefaultMinFreeDiskBytes = 2 * 1024 * 1024 * 1024 // 2 GB
+
+	// retainMarkerFile holds the time until which a retained workspace is kept
+	retainMarkerFile = ".retain-until"
+)
+
+// Workspace is a directory on the session host that holds every file produced while processing one workflow run.
+// It is created when the session starts and removed when the session completes, unless the workflow retains it
+// for debugging; retained workspaces are removed by RemoveExpiredWorkspaces.
+type Workspace struct {
+	Dir string
+}
+
+// Path returns the location of name inside the workspace. name is a plain file name, or a path inside the workspace
+// as returned by Path; any other path is rejected instead of being moved into the workspace.
+func (w Workspace) Path(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		if filepath.Dir(filepath.Clean(name)) == filepath.Clean(w.Dir) {
+			return filepath.Clean(name), nil
+		}
+		return "", fmt.Errorf("%s is not inside the workspace %s", name, w.Dir)
+	}
+	if !isPlainFileName(name) {
+		return "", fmt.Errorf("%q is not a plain file name", name)
+	}
+	return filepath.Join(w.Dir, name), nil
+}
+
+// isPlainFileName reports whether name is a single path element that names a file
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name && !strings.ContainsAny(name, `/\`)
+}
+
+// TempFile creates a new empty file inside the workspace; see ioutil.TempFile for the pattern format
+func (w Workspace) TempFile(pattern string) (*os.File, error) {
+	return ioutil.TempFile(w.Dir, pattern)
+}
+
+func (a *Activities) workspaceRoot() string {
+	if a.WorkspaceRoot != "" {
+		return a.WorkspaceRoot
+	}
+	return filepath.Join(os.TempDir(), "mediaprocessing")
+}
+
+// CreateWorkspaceActivity creates the workspace for the current workflow run after checking that the volume
+// has enough free space. Creating the workspace again for the same run reuses the existing directory.
+func (a *Activities) CreateWorkspaceActivity(ctx context.Context) (Workspace, error) {
+	logger := activity.GetLogger(ctx)
+	execution := activity.GetInfo(ctx).WorkflowExecution
+	root := a.workspaceRoot()
+	ws := Workspace{Dir: filepath.Join(root, pathSafeName(execution.ID), pathSafeName(execution.RunID))}
+
+	if err := os.MkdirAll(ws.Dir, 0755); err != nil {
+		logger.Error("unable to create workspace", "dir", ws.Dir, "Error", err)
+		return Workspace{}, err
+	}
+
+	minFree := a.MinFreeDiskBytes
+	if minFree == 0 {
+		minFree = DefaultMinFreeDiskBytes
+	}
+	free, err := freeDiskBytes(ws.Dir)
+	if err != nil {
+		// not every platform can report free space; processing will fail later if the disk fills up
+		logger.Warn("unable to determine free disk space", "dir", ws.Dir, "Error", err)
+	} else if free < minFree {
+		os.RemoveAll(ws.Dir)
+		return Workspace{}, temporal.NewApplicationError(
+			fmt.Sprintf("workspace volume has %d bytes free, %d required", free, minFree), ErrTypeInsufficientDiskSpace)
+	}
+
+	logger.Info("created workspace", "dir", ws.Dir)
+	return ws, nil
+}
+
+// checkWorkspace makes sure that nothing outside of the configured root is touched, whatever the workflow passed in
+func (a *Activities) checkWorkspace(ws Workspace) error {
+	rel, err := filepath.Rel(a.workspaceRoot(), ws.Dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("%s is not a workspace under %s", ws.Dir, a.workspaceRoot()), ErrTypeInvalidWorkspace, err)
+	}
+	return nil
+}
+
+// RemoveWorkspaceActivity deletes the workspace and everything in it
+func (a *Activities) RemoveWorkspaceActivity(ctx context.Context, ws Workspace) error {
+	logger := activity.GetLogger(ctx)
+
+	if err := a.checkWorkspace(ws); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(ws.Dir); err != nil {
+		logger.Error("unable to remove workspace", "dir", ws.Dir, "Error", err)
+		return err
+	}
+	// drop the per-workflow parent as well once its last run is gone
+	os.Remove(filepath.Dir(ws.Dir))
+
+	logger.Info("removed workspace", "dir", ws.Dir)
+	return nil
+}
+
+// DeleteLocalArtifactsActivity deletes the named files from the workspace once they are no longer needed, such as
+// the merged output after it was uploaded. Files that are already gone are not an error.
+func (a *Activities) DeleteLocalArtifactsActivity(ctx context.Context, ws Workspace, fileNames []string) error {
+	logger := activity.GetLogger(ctx)
+
+	if err := a.checkWorkspace(ws); err != nil {
+		return err
+	}
+	for _, fileName := range fileNames {
+		path, err := ws.Path(fileName)
+		if err != nil {
+			return temporal.NewNonRetryableApplicationError(err.Error(), ErrTypeInvalidWorkspace, nil)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Error("unable to delete local artifact", "file", path, "Error", err)
+			return err
+		}
+		logger.Info("deleted local artifact", "file", path)
+	}
+	return nil
+}
+
+// RetainWorkspaceActivity keeps the workspace on the host until the given time instead of removing it,
+// so that the files of a run can be inspected
+func (a *Activities) RetainWorkspaceActivity(ctx context.Context, ws Workspace, until time.Time) error {
+	logger := activity.GetLogger(ctx)
+
+	if err := a.checkWorkspace(ws); err != nil {
+		return err
+	}
+	marker := filepath.Join(ws.Dir, retainMarkerFile)
+	if err := ioutil.WriteFile(marker, []byte(until.UTC().Format(time.RFC3339)), 0644); err != nil {
+		logger.Error("unable to retain workspace", "dir", ws.Dir, "Error", err)
+		return err
+	}
+
+	logger.Info("retained workspace", "dir", ws.Dir, "until", until)
+	return nil
+}
+
+// RemoveExpiredWorkspaces removes the retained workspaces whose retention ended before now and returns their
+// directories. Workspaces without a retention marker belong to running sessions and are left alone.
+func (a *Activities) RemoveExpiredWorkspaces(now time.Time) ([]string, error) {
+	markers, err := filepath.Glob(filepath.Join(a.workspaceRoot(), "*", "*", retainMarkerFile))
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, marker := range markers {
+		b, err := ioutil.ReadFile(marker)
+		if err != nil {
+			continue
+		}
+		until, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+		if err == nil && until.After(now) {
+			continue
+		}
+
+		dir := filepath.Dir(marker)
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, err
+		}
+		os.Remove(filepath.Dir(dir))
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
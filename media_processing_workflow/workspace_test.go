@@ -0,0 +1,116 @@
+package media_processing_workflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func Test_WorkspaceLifecycle(t *testing.T) {
+	root, err := ioutil.TempDir("", "workspaceroot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{WorkspaceRoot: root, MinFreeDiskBytes: 1}
+	env.RegisterActivity(a)
+
+	val, err := env.ExecuteActivity(a.CreateWorkspaceActivity)
+	assert.NoError(t, err)
+	var ws Workspace
+	assert.NoError(t, val.Get(&ws))
+	assert.True(t, strings.HasPrefix(ws.Dir, root+string(filepath.Separator)))
+	assert.DirExists(t, ws.Dir)
+
+	_, err = env.ExecuteActivity(a.RemoveWorkspaceActivity, Workspace{Dir: filepath.Dir(root)})
+	assert.Error(t, err)
+	assert.DirExists(t, ws.Dir)
+
+	_, err = env.ExecuteActivity(a.RemoveWorkspaceActivity, ws)
+	assert.NoError(t, err)
+	assert.NoDirExists(t, ws.Dir)
+}
+
+func Test_DeleteLocalArtifactsActivity(t *testing.T) {
+	root, err := ioutil.TempDir("", "workspaceroot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	ws := Workspace{Dir: filepath.Join(root, "wf", "run")}
+	assert.NoError(t, os.MkdirAll(ws.Dir, 0755))
+	output := filepath.Join(ws.Dir, "output.mp4")
+	encoded := filepath.Join(ws.Dir, "encoded.mp4")
+	assert.NoError(t, ioutil.WriteFile(output, []byte("merged"), 0644))
+	assert.NoError(t, ioutil.WriteFile(encoded, []byte("encoded"), 0644))
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{WorkspaceRoot: root}
+	env.RegisterActivity(a)
+
+	_, err = env.ExecuteActivity(a.DeleteLocalArtifactsActivity, ws, []string{"output.mp4", "missing.mp4"})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, output)
+	assert.FileExists(t, encoded)
+
+	// paths outside of the workspace are refused, even when their file name is in the workspace
+	_, err = env.ExecuteActivity(a.DeleteLocalArtifactsActivity, ws, []string{filepath.Join(root, "encoded.mp4")})
+	assert.Error(t, err)
+	assert.FileExists(t, encoded)
+
+	_, err = env.ExecuteActivity(a.DeleteLocalArtifactsActivity, Workspace{Dir: root}, []string{"output.mp4"})
+	assert.Error(t, err)
+}
+
+func Test_WorkspacePath(t *testing.T) {
+	ws := Workspace{Dir: filepath.Join(os.TempDir(), "wf", "run")}
+
+	path, err := ws.Path("output.mp4")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(ws.Dir, "output.mp4"), path)
+	// paths returned by Path are accepted again
+	path, err = ws.Path(path)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(ws.Dir, "output.mp4"), path)
+
+	for _, name := range []string{"", ".", "..", "out/output.mp4", "../output.mp4", filepath.Join(os.TempDir(), "output.mp4")} {
+		_, err := ws.Path(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func Test_RemoveExpiredWorkspaces(t *testing.T) {
+	root, err := ioutil.TempDir("", "workspaceroot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	now := time.Now()
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	a := &Activities{WorkspaceRoot: root}
+	env.RegisterActivity(a)
+
+	expired := Workspace{Dir: filepath.Join(root, "wf1", "run")}
+	retained := Workspace{Dir: filepath.Join(root, "wf2", "run")}
+	running := Workspace{Dir: filepath.Join(root, "wf3", "run")}
+	for _, ws := range []Workspace{expired, retained, running} {
+		assert.NoError(t, os.MkdirAll(ws.Dir, 0755))
+	}
+	_, err = env.ExecuteActivity(a.RetainWorkspaceActivity, expired, now.Add(-time.Minute))
+	assert.NoError(t, err)
+	_, err = env.ExecuteActivity(a.RetainWorkspaceActivity, retained, now.Add(time.Hour))
+	assert.NoError(t, err)
+
+	removed, err := a.RemoveExpiredWorkspaces(now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{expired.Dir}, removed)
+	assert.NoDirExists(t, filepath.Dir(expired.Dir))
+	assert.DirExists(t, retained.Dir)
+	assert.DirExists(t, running.Dir)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package media_processing_workflow
+
+import "errors"
+
+// freeDiskBytes is not implemented on windows; the workspace precheck is skipped there
+func freeDiskBytes(dir string) (uint64, error) {
+	return 0, errors.New("free disk space check is not supported on windows")
+}